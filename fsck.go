@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/httplock/httplock/internal/storage"
+	"github.com/httplock/httplock/internal/template"
+	"github.com/spf13/cobra"
+)
+
+var fsckOpts struct {
+	quarantine bool
+}
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Verify the integrity of the storage",
+	Long: `Verify every root in the storage index, rehashing each blob.
+Missing and corrupt blobs, and directory entries that cannot be followed, are reported.
+The command fails when any problem is found.`,
+	Args: cobra.ExactArgs(0),
+	RunE: runFsck,
+}
+
+func init() {
+	fsckCmd.Flags().BoolVarP(&fsckOpts.quarantine, "quarantine", "", false, "Move corrupt blobs out of the storage")
+	fsckCmd.Flags().StringVarP(&rootOpts.format, "format", "", "{{printPretty .}}", "Format output with go template syntax")
+	rootCmd.AddCommand(fsckCmd)
+}
+
+func runFsck(cmd *cobra.Command, args []string) error {
+	conf, err := config.New(config.ConfigOpts{
+		ConfFile: rootOpts.confFile,
+		Log:      log,
+	})
+	if err != nil {
+		return err
+	}
+	s, err := storage.Get(conf)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+	report, err := storage.Check(s, storage.CheckOpts{
+		Quarantine: fsckOpts.quarantine,
+	})
+	if err != nil {
+		return err
+	}
+	err = template.Writer(os.Stdout, rootOpts.format, report)
+	if err != nil {
+		return err
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d problems found in %d blobs", len(report.Problems), report.Blobs)
+	}
+	return nil
+}
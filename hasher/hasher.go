@@ -3,38 +3,109 @@ package hasher
 
 import (
 	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"hash"
 	"io"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+const (
+	SHA256  = "sha256"
+	SHA512  = "sha512"
+	BLAKE3  = "blake3"
+	Default = SHA256
 )
 
-const algorithm = "sha256"
+// algorithms maps each supported algorithm to a constructor
+var algorithms = map[string]func() hash.Hash{
+	SHA256: sha256.New,
+	SHA512: sha512.New,
+	BLAKE3: func() hash.Hash { return blake3.New(32, nil) },
+}
 
 type Reader struct {
-	h hash.Hash
-	r io.Reader
+	algo string
+	h    hash.Hash
+	r    io.Reader
 }
 
 type Writer struct {
-	h hash.Hash
-	w io.Writer
+	algo string
+	h    hash.Hash
+	w    io.Writer
+}
+
+// Supported returns true when the algorithm can be used to generate hashes
+func Supported(algo string) bool {
+	_, ok := algorithms[algo]
+	return ok
+}
+
+// Algorithm returns the algorithm of a hash, e.g. "sha256" from "sha256:abcd..."
+func Algorithm(h string) (string, error) {
+	algo, enc, ok := strings.Cut(h, ":")
+	if !ok || algo == "" || enc == "" {
+		return "", fmt.Errorf("invalid hash %q", h)
+	}
+	if !Supported(algo) {
+		return "", fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+	return algo, nil
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	if algo == "" {
+		algo = Default
+	}
+	fn, ok := algorithms[algo]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+	return fn(), nil
 }
 
 func FromBytes(b []byte) (string, error) {
-	s := sha256.New()
-	_, err := s.Write(b)
+	return FromBytesAlgo(Default, b)
+}
+
+// FromBytesAlgo hashes a byte array with the algorithm, an empty algorithm uses the default
+func FromBytesAlgo(algo string, b []byte) (string, error) {
+	if algo == "" {
+		algo = Default
+	}
+	h, err := newHash(algo)
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%s:%x", algorithm, s.Sum(nil)), nil
+	_, err = h.Write(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%x", algo, h.Sum(nil)), nil
 }
 
 func NewReader(r io.Reader) *Reader {
-	h := Reader{
-		h: sha256.New(),
-		r: r,
+	h, _ := NewReaderAlgo(Default, r)
+	return h
+}
+
+// NewReaderAlgo returns a reader that hashes content with the algorithm, an empty algorithm uses the default
+func NewReaderAlgo(algo string, r io.Reader) (*Reader, error) {
+	if algo == "" {
+		algo = Default
+	}
+	h, err := newHash(algo)
+	if err != nil {
+		return nil, err
 	}
-	return &h
+	return &Reader{
+		algo: algo,
+		h:    h,
+		r:    r,
+	}, nil
 }
 
 func (hr *Reader) Read(p []byte) (int, error) {
@@ -49,15 +120,28 @@ func (hr *Reader) Read(p []byte) (int, error) {
 }
 
 func (hr *Reader) String() string {
-	return fmt.Sprintf("%s:%x", algorithm, hr.h.Sum(nil))
+	return fmt.Sprintf("%s:%x", hr.algo, hr.h.Sum(nil))
 }
 
 func NewWriter(w io.Writer) *Writer {
-	h := Writer{
-		h: sha256.New(),
-		w: w,
+	h, _ := NewWriterAlgo(Default, w)
+	return h
+}
+
+// NewWriterAlgo returns a writer that hashes content with the algorithm, an empty algorithm uses the default
+func NewWriterAlgo(algo string, w io.Writer) (*Writer, error) {
+	if algo == "" {
+		algo = Default
+	}
+	h, err := newHash(algo)
+	if err != nil {
+		return nil, err
 	}
-	return &h
+	return &Writer{
+		algo: algo,
+		h:    h,
+		w:    w,
+	}, nil
 }
 
 func (hw *Writer) Write(p []byte) (int, error) {
@@ -72,5 +156,5 @@ func (hw *Writer) Write(p []byte) (int, error) {
 }
 
 func (hw *Writer) String() string {
-	return fmt.Sprintf("%s:%x", algorithm, hw.h.Sum(nil))
+	return fmt.Sprintf("%s:%x", hw.algo, hw.h.Sum(nil))
 }
@@ -6,28 +6,65 @@ import (
 	"testing"
 )
 
-func TestHashReader(t *testing.T) {
-	var testHash = []struct {
-		name  string
-		input []byte
-		hash  string
-	}{
-		{
-			name:  "empty",
-			input: []byte{},
-			hash:  "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
-		},
-		{
-			name:  "hello",
-			input: []byte("Hello world"),
-			hash:  "sha256:64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
-		},
-	}
+var testHash = []struct {
+	name  string
+	algo  string
+	input []byte
+	hash  string
+}{
+	{
+		name:  "empty",
+		algo:  SHA256,
+		input: []byte{},
+		hash:  "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	},
+	{
+		name:  "hello",
+		algo:  SHA256,
+		input: []byte("Hello world"),
+		hash:  "sha256:64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+	},
+	{
+		name:  "default hello",
+		algo:  "",
+		input: []byte("Hello world"),
+		hash:  "sha256:64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c",
+	},
+	{
+		name:  "sha512 empty",
+		algo:  SHA512,
+		input: []byte{},
+		hash:  "sha512:cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+	},
+	{
+		name:  "sha512 hello",
+		algo:  SHA512,
+		input: []byte("Hello world"),
+		hash:  "sha512:b7f783baed8297f0db917462184ff4f08e69c2d5e5f79a942600f9725f58ce1f29c18139bf80b06c0fff2bdd34738452ecf40c488c22a7e3d80cdf6f9c1c0d47",
+	},
+	{
+		name:  "blake3 empty",
+		algo:  BLAKE3,
+		input: []byte{},
+		hash:  "blake3:af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+	},
+	{
+		name:  "blake3 hello",
+		algo:  BLAKE3,
+		input: []byte("Hello world"),
+		hash:  "blake3:e7e6fb7d2869d109b62cdb1227208d4016cdaa0af6603d95223c6a698137d945",
+	},
+}
 
+func TestHashReader(t *testing.T) {
 	for _, tt := range testHash {
 		t.Run(tt.name, func(t *testing.T) {
 			buf := bytes.NewBuffer(tt.input)
-			h := NewReader(buf)
+			h, err := NewReaderAlgo(tt.algo, buf)
+			if err != nil {
+				t.Errorf("Error creating reader: %v", err)
+				return
+			}
 			result, err := io.ReadAll(h)
 			if err != nil {
 				t.Errorf("Error reading from hasher: %v", err)
@@ -38,14 +75,73 @@ func TestHashReader(t *testing.T) {
 			if h.String() != tt.hash {
 				t.Errorf("Read got hash %s, expected %s", h.String(), tt.hash)
 			}
-			hstr, err := FromBytes(tt.input)
+			hstr, err := FromBytesAlgo(tt.algo, tt.input)
 			if err != nil {
 				t.Errorf("Error hashing bytes: %v", err)
 			} else if hstr != tt.hash {
 				t.Errorf("FromBytes got hash %s, expected %s", hstr, tt.hash)
 			}
+			expectAlgo := tt.algo
+			if expectAlgo == "" {
+				expectAlgo = Default
+			}
+			algo, err := Algorithm(tt.hash)
+			if err != nil {
+				t.Errorf("Error parsing hash: %v", err)
+			} else if algo != expectAlgo {
+				t.Errorf("Algorithm got %s, expected %s", algo, expectAlgo)
+			}
 		})
 	}
 }
 
-// TODO: test Hasher Writer
+func TestHashWriter(t *testing.T) {
+	for _, tt := range testHash {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			h, err := NewWriterAlgo(tt.algo, &buf)
+			if err != nil {
+				t.Errorf("Error creating writer: %v", err)
+				return
+			}
+			_, err = h.Write(tt.input)
+			if err != nil {
+				t.Errorf("Error writing to hasher: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.input) {
+				t.Errorf("Write got bytes %s, expected %s", buf.Bytes(), tt.input)
+			}
+			if h.String() != tt.hash {
+				t.Errorf("Write got hash %s, expected %s", h.String(), tt.hash)
+			}
+		})
+	}
+}
+
+func TestHashDefault(t *testing.T) {
+	hstr, err := FromBytes([]byte("Hello world"))
+	if err != nil {
+		t.Errorf("Error hashing bytes: %v", err)
+		return
+	}
+	if hstr != "sha256:64ec88ca00b268e5ba1a35678a1b5316d212f4f366b2477232534a8aeca37f3c" {
+		t.Errorf("FromBytes got hash %s, expected sha256", hstr)
+	}
+	if NewWriter(io.Discard).String()[:7] != "sha256:" || NewReader(&bytes.Buffer{}).String()[:7] != "sha256:" {
+		t.Errorf("default reader or writer is not sha256")
+	}
+}
+
+func TestHashInvalid(t *testing.T) {
+	for _, h := range []string{"", "sha256", "md5:d41d8cd98f00b204e9800998ecf8427e", ":abcd", "sha256:"} {
+		if _, err := Algorithm(h); err == nil {
+			t.Errorf("Algorithm did not fail on %q", h)
+		}
+	}
+	if _, err := NewReaderAlgo("md5", &bytes.Buffer{}); err == nil {
+		t.Errorf("NewReaderAlgo did not fail on md5")
+	}
+	if _, err := FromBytesAlgo("md5", []byte{}); err == nil {
+		t.Errorf("FromBytesAlgo did not fail on md5")
+	}
+}
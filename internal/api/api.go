@@ -9,7 +9,9 @@ import (
 	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/httplock/httplock/internal/api/docs"
@@ -38,6 +40,19 @@ type storageMetaResp struct {
 	StatusCode int
 	ContentLen int64
 	Headers    http.Header
+	Trailers   http.Header
+}
+
+type storageMetaTiming struct {
+	TTFB     time.Duration
+	Duration time.Duration
+	Size     int64
+}
+
+type storageMetaPolicy struct {
+	Method string
+	URL    string
+	Reason string
 }
 
 // Start runs an api service
@@ -76,8 +91,12 @@ func Start(conf config.Config, s storage.Storage, certs *cert.Cert) (*http.Serve
 	r.GET("/api/root/:root/info", a.rootInfo)
 	r.GET("/api/root/:root/resp", a.rootResp)
 	r.GET("/api/root/:root/diff", a.rootDiff)
+	r.GET("/api/root/:root/insecure", a.rootInsecure)
+	r.GET("/api/root/:root/timing", a.rootTiming)
 	r.GET("/api/root/:root/export", a.rootExport)
 	r.PUT("/api/root/:root/import", a.rootImport)
+	r.GET("/api/storage/check", a.storageCheck)
+	r.POST("/api/storage/check", a.storageCheck)
 	r.GET("/swagger/*any", gin.WrapH(httpSwagger.Handler()))
 	r.StaticFS("/ui/", http.FS(uiFS))
 
@@ -117,26 +136,38 @@ func (a *api) caGetPEM(c *gin.Context) {
 // tokenCreate creates a new token for recording a session
 // @Summary     Token create
 // @Description returns a new uuid for recording a session
+// @Accept      application/json
 // @Produce     application/json
-// @Param       hash query string false "hash used to initialize the response cache"
+// @Param       hash query string       false "hash used to initialize the response cache"
+// @Param       conf body  config.Token false "token configuration"
 // @Success     201
+// @Failure     400
 // @Failure     500
 // @Router      /api/token [post]
 func (a *api) tokenCreate(c *gin.Context) {
+	// an optional body configures the token
+	conf := config.Token{}
+	err := json.NewDecoder(c.Request.Body).Decode(&conf)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		a.conf.Log.Warnf("failed to parse token config: %v", err)
+		return
+	}
 	// check for base hash arg, attempt to retrieve that instead of creating a NewRoot
 	hash := c.Query("hash")
 	var name string
-	var err error
+	var root *storage.Root
 	if hash != "" {
-		name, _, err = a.s.RootCreateFrom(hash)
+		name, root, err = a.s.RootCreateFrom(hash)
 	} else {
-		name, _, err = a.s.RootCreate()
+		name, root, err = a.s.RootCreate()
 	}
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		a.conf.Log.Warnf("failed to create token: %v", err)
 		return
 	}
+	root.SetConf(conf)
 	token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("token:%s", name)))
 	result := struct {
 		UUID string `json:"uuid"`
@@ -177,7 +208,9 @@ func (a *api) tokenDestroy(c *gin.Context) {
 // @Summary     Token save
 // @Description Saves a uuid token, returning an immutable hash
 // @Produce     application/json
-// @Param       id path string true "uuid"
+// @Param       id          path  string   true  "uuid"
+// @Param       label       query []string false "labels in key=value format, e.g. branch=main, replacing the labels of an earlier save of the same hash, an empty value removes them"
+// @Param       description query string   false "description of the root"
 // @Success     201
 // @Failure     400
 // @Failure     500
@@ -188,11 +221,32 @@ func (a *api) tokenSave(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	labels, err := parseLabels(c.QueryArray("label"))
+	if err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		a.conf.Log.Warnf("failed to parse labels: %v", err)
+		return
+	}
 	// SaveRoot generates the hash and saves to a list of roots
 	root, err := a.s.RootOpen(id)
 	if err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
+		a.conf.Log.Warnf("failed to open root: %v", err)
+		return
 	}
+	requests, size, err := root.Stats("-resp-head")
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		a.conf.Log.Warnf("failed to read root stats: %v", err)
+		return
+	}
+	root.SetInfo(storage.RootInfo{
+		Labels:      labels,
+		Description: c.Query("description"),
+		Creator:     id,
+		Requests:    requests,
+		Bytes:       size,
+	})
 	h, err := a.s.RootSave(root)
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
@@ -207,21 +261,104 @@ func (a *api) tokenSave(c *gin.Context) {
 	c.JSON(http.StatusCreated, result)
 }
 
+// parseLabels converts key=value pairs to a map, empty pairs return an empty map to remove existing labels
+func parseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := map[string]string{}
+	for _, pair := range pairs {
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if k == "" || !ok {
+			return nil, fmt.Errorf("invalid label %q, expected key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
 // rootList returns a list of roots
 // @Summary     Root List
-// @Description Lists the roots
+// @Description Lists the roots, optionally filtered by the metadata in the index
 // @Produce     application/json
+// @Param       label       query []string false "labels in key=value format, or key to match any value, all labels must match"
+// @Param       creator     query string   false "token that recorded the root"
+// @Param       description query string   false "text contained in the description"
+// @Param       detail      query bool     false "return the index metadata of each root instead of the hash"
 // @Success     200
+// @Failure     400
 // @Failure     500
 // @Router      /api/root/ [get]
 func (a *api) rootList(c *gin.Context) {
+	labels := c.QueryArray("label")
+	for _, label := range labels {
+		if label == "" || label[0] == '=' {
+			c.AbortWithStatus(http.StatusBadRequest)
+			a.conf.Log.Warnf("invalid label filter %q", label)
+			return
+		}
+	}
+	detail := false
+	if q := c.Query("detail"); q != "" {
+		v, err := strconv.ParseBool(q)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		detail = v
+	}
+	creator := c.Query("creator")
+	description := c.Query("description")
 	index := a.s.Index()
 	roots := []string{}
-	for root := range index.Roots {
+	for root, ir := range index.Roots {
+		if ir == nil {
+			ir = &storage.IndexRoot{}
+		}
+		if creator != "" && ir.Creator != creator {
+			continue
+		}
+		if description != "" && !strings.Contains(ir.Description, description) {
+			continue
+		}
+		if !matchLabels(ir.Labels, labels) {
+			continue
+		}
 		roots = append(roots, root)
 	}
 	sort.Strings(roots)
-	c.JSON(http.StatusOK, roots)
+	if !detail {
+		c.JSON(http.StatusOK, roots)
+		return
+	}
+	type rootEntry struct {
+		Hash string `json:"hash"`
+		storage.IndexRoot
+	}
+	result := make([]rootEntry, 0, len(roots))
+	for _, root := range roots {
+		entry := rootEntry{Hash: root}
+		if ir := index.Roots[root]; ir != nil {
+			entry.IndexRoot = *ir
+		}
+		result = append(result, entry)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// matchLabels returns true when every filter is found, a filter without a value matches any value of the key
+func matchLabels(labels map[string]string, filters []string) bool {
+	for _, filter := range filters {
+		k, v, hasValue := strings.Cut(filter, "=")
+		lv, ok := labels[k]
+		if !ok || (hasValue && lv != v) {
+			return false
+		}
+	}
+	return true
 }
 
 // rootDir returns the directory contents in a root fs
@@ -414,11 +551,181 @@ func (a *api) rootResp(c *gin.Context) {
 			wh.Add(k, v)
 		}
 	}
+	for k := range metaResp.Trailers {
+		wh.Add("Trailer", k)
+	}
 	c.Status(metaResp.StatusCode)
 	_, err = io.Copy(c.Writer, rdrBody)
 	if err != nil {
 		a.conf.Log.Warnf("failed to write body of response: %v", err)
 	}
+	for k, vv := range metaResp.Trailers {
+		for _, v := range vv {
+			wh.Add(k, v)
+		}
+	}
+}
+
+// rootInsecure returns the plain http requests in a root
+// @Summary     Root Insecure
+// @Description Lists requests made without TLS, including requests rejected by the policy
+// @Produce     application/json
+// @Param       root path string true "root hash or uuid"
+// @Success     200
+// @Failure     400
+// @Failure     500
+// @Router      /api/root/{root}/insecure [get]
+func (a *api) rootInsecure(c *gin.Context) {
+	rootID, ok := c.Params.Get("root")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	root, err := a.s.RootOpen(rootID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		a.conf.Log.Warnf("failed to open root: %v", err)
+		return
+	}
+	type insecureEntry struct {
+		URL      string   `json:"url"`
+		Path     []string `json:"path"`
+		Requests []string `json:"requests"` // hashes of recorded requests
+		Policy   []string `json:"policy"`   // reasons the policy flagged or rejected the url
+	}
+	report := []insecureEntry{}
+	// the first level of a root is the host, the second is the url
+	hosts, err := root.List([]string{})
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		a.conf.Log.Warnf("failed to list root: %v", err)
+		return
+	}
+	for host, hostEntry := range hosts {
+		if hostEntry.Kind != storage.KindDir {
+			continue
+		}
+		urls, err := root.List([]string{host})
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			a.conf.Log.Warnf("failed to list root: %v", err)
+			return
+		}
+		for u, urlEntry := range urls {
+			if urlEntry.Kind != storage.KindDir || !strings.HasPrefix(strings.ToLower(u), "http://") {
+				continue
+			}
+			entry := insecureEntry{
+				URL:      u,
+				Path:     []string{host, u},
+				Requests: []string{},
+				Policy:   []string{},
+			}
+			files, err := root.List(entry.Path)
+			if err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				a.conf.Log.Warnf("failed to list root: %v", err)
+				return
+			}
+			for name := range files {
+				switch {
+				case strings.HasSuffix(name, "-resp-head"):
+					entry.Requests = append(entry.Requests, strings.TrimSuffix(name, "-resp-head"))
+				case strings.HasSuffix(name, "-policy"):
+					metaPolicy, err := a.readPolicy(root, append(entry.Path, name))
+					if err != nil {
+						c.AbortWithStatus(http.StatusInternalServerError)
+						a.conf.Log.Warnf("failed to read policy entry: %v", err)
+						return
+					}
+					entry.Policy = append(entry.Policy, metaPolicy.Reason)
+				}
+			}
+			sort.Strings(entry.Requests)
+			sort.Strings(entry.Policy)
+			report = append(report, entry)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].URL < report[j].URL
+	})
+	c.JSON(http.StatusOK, report)
+}
+
+func (a *api) readPolicy(root *storage.Root, path []string) (storageMetaPolicy, error) {
+	metaPolicy := storageMetaPolicy{}
+	rdr, err := root.Read(path)
+	if err != nil {
+		return metaPolicy, err
+	}
+	defer rdr.Close()
+	err = json.NewDecoder(rdr).Decode(&metaPolicy)
+	return metaPolicy, err
+}
+
+// rootTiming returns the recorded timing of requests in a root
+// @Summary     Root Timing
+// @Description Lists the time to first byte, duration, and size of recorded responses, slowest first
+// @Produce     application/json
+// @Param       root path string true "root hash or uuid"
+// @Success     200
+// @Failure     400
+// @Failure     500
+// @Router      /api/root/{root}/timing [get]
+func (a *api) rootTiming(c *gin.Context) {
+	rootID, ok := c.Params.Get("root")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	root, err := a.s.RootOpen(rootID)
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		a.conf.Log.Warnf("failed to open root: %v", err)
+		return
+	}
+	paths, err := root.ListMeta()
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		a.conf.Log.Warnf("failed to list metadata: %v", err)
+		return
+	}
+	type timingEntry struct {
+		Path       []string `json:"path"`
+		Hash       string   `json:"hash"`
+		TTFBMs     float64  `json:"ttfbMs"`
+		DurationMs float64  `json:"durationMs"`
+		Size       int64    `json:"size"`
+	}
+	report := []timingEntry{}
+	for _, path := range paths {
+		// timing is stored on the path of the request hash, without the file suffix
+		if len(path) < 2 {
+			continue
+		}
+		metaTiming := storageMetaTiming{}
+		err = root.GetMeta(path, &metaTiming)
+		if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			a.conf.Log.Warnf("failed to read metadata: %v", err)
+			return
+		}
+		// records without timing only hold other metadata, such as the tls chain
+		if metaTiming.Duration <= 0 {
+			continue
+		}
+		report = append(report, timingEntry{
+			Path:       path[:len(path)-1],
+			Hash:       path[len(path)-1],
+			TTFBMs:     float64(metaTiming.TTFB) / float64(time.Millisecond),
+			DurationMs: float64(metaTiming.Duration) / float64(time.Millisecond),
+			Size:       metaTiming.Size,
+		})
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		return report[i].DurationMs > report[j].DurationMs
+	})
+	c.JSON(http.StatusOK, report)
 }
 
 // rootDiff returns the differences between two roots
@@ -521,3 +828,38 @@ func (a *api) rootImport(c *gin.Context) {
 // report
 
 // status
+
+// storageCheck verifies the blobs of every root in storage
+// @Summary     Storage check
+// @Description Rehashes every blob used by a saved root, reporting missing, corrupt, and orphaned entries.
+// @Description Corrupt blobs are moved out of storage with a POST request and the quarantine parameter.
+// @Description Quarantine is rejected on storage that cannot remove blobs, such as tiered storage.
+// @Produce     application/json
+// @Param       quarantine query bool false "quarantine corrupt blobs, POST only"
+// @Success     200
+// @Failure     400
+// @Failure     500
+// @Router      /api/storage/check [get]
+// @Router      /api/storage/check [post]
+func (a *api) storageCheck(c *gin.Context) {
+	opts := storage.CheckOpts{}
+	if q := c.Query("quarantine"); q != "" {
+		quarantine, err := strconv.ParseBool(q)
+		if err != nil || (quarantine && c.Request.Method != http.MethodPost) {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		opts.Quarantine = quarantine
+	}
+	report, err := storage.Check(a.s, opts)
+	if errors.Is(err, storage.ErrQuarantineUnsupported) {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		a.conf.Log.Warnf("failed to check storage: %v", err)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -41,15 +41,47 @@ const docTemplate = `{
         },
         "/api/root/": {
             "get": {
-                "description": "Lists the roots",
+                "description": "Lists the roots, optionally filtered by the metadata in the index",
                 "produces": [
                     "application/json"
                 ],
                 "summary": "Root List",
+                "parameters": [
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "description": "labels in key=value format, or key to match any value, all labels must match",
+                        "name": "label",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "token that recorded the root",
+                        "name": "creator",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "text contained in the description",
+                        "name": "description",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "return the index metadata of each root instead of the hash",
+                        "name": "detail",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK"
                     },
+                    "400": {
+                        "description": "Bad Request"
+                    },
                     "500": {
                         "description": "Internal Server Error"
                     }
@@ -270,6 +302,35 @@ const docTemplate = `{
                 }
             }
         },
+        "/api/root/{root}/insecure": {
+            "get": {
+                "description": "Lists requests made without TLS, including requests rejected by the policy",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Root Insecure",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "root hash or uuid",
+                        "name": "root",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
         "/api/root/{root}/resp": {
             "get": {
                 "description": "Return the response from a request, including headers",
@@ -313,9 +374,95 @@ const docTemplate = `{
                 }
             }
         },
+        "/api/root/{root}/timing": {
+            "get": {
+                "description": "Lists the time to first byte, duration, and size of recorded responses, slowest first",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Root Timing",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "root hash or uuid",
+                        "name": "root",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
+        "/api/storage/check": {
+            "get": {
+                "description": "Rehashes every blob used by a saved root, reporting missing, corrupt, and orphaned entries.\nCorrupt blobs are moved out of storage with a POST request and the quarantine parameter.\nQuarantine is rejected on storage that cannot remove blobs, such as tiered storage.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Storage check",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "quarantine corrupt blobs, POST only",
+                        "name": "quarantine",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            },
+            "post": {
+                "description": "Rehashes every blob used by a saved root, reporting missing, corrupt, and orphaned entries.\nCorrupt blobs are moved out of storage with a POST request and the quarantine parameter.\nQuarantine is rejected on storage that cannot remove blobs, such as tiered storage.",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Storage check",
+                "parameters": [
+                    {
+                        "type": "boolean",
+                        "description": "quarantine corrupt blobs, POST only",
+                        "name": "quarantine",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK"
+                    },
+                    "400": {
+                        "description": "Bad Request"
+                    },
+                    "500": {
+                        "description": "Internal Server Error"
+                    }
+                }
+            }
+        },
         "/api/token": {
             "post": {
                 "description": "returns a new uuid for recording a session",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
@@ -326,12 +473,23 @@ const docTemplate = `{
                         "description": "hash used to initialize the response cache",
                         "name": "hash",
                         "in": "query"
+                    },
+                    {
+                        "description": "token configuration",
+                        "name": "conf",
+                        "in": "body",
+                        "schema": {
+                            "$ref": "#/definitions/config.Token"
+                        }
                     }
                 ],
                 "responses": {
                     "201": {
                         "description": "Created"
                     },
+                    "400": {
+                        "description": "Bad Request"
+                    },
                     "500": {
                         "description": "Internal Server Error"
                     }
@@ -381,6 +539,21 @@ const docTemplate = `{
                         "name": "id",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "description": "labels in key=value format, e.g. branch=main, replacing the labels of an earlier save of the same hash, an empty value removes them",
+                        "name": "label",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "description of the root",
+                        "name": "description",
+                        "in": "query"
                     }
                 ],
                 "responses": {
@@ -396,6 +569,66 @@ const docTemplate = `{
                 }
             }
         }
+    },
+    "definitions": {
+        "config.Policy": {
+            "type": "object",
+            "properties": {
+                "allow": {
+                    "description": "when defined, requests must match an allow rule",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/config.PolicyRule"
+                    }
+                },
+                "deny": {
+                    "description": "requests matching a deny rule are always rejected",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/config.PolicyRule"
+                    }
+                },
+                "insecure": {
+                    "description": "Insecure is the action for plain http requests: allow, flag, or deny",
+                    "type": "string",
+                    "enum": [
+                        "allow",
+                        "flag",
+                        "deny"
+                    ]
+                }
+            }
+        },
+        "config.PolicyRule": {
+            "type": "object",
+            "properties": {
+                "host": {
+                    "description": "glob of the hostname, e.g. *.example.com",
+                    "type": "string"
+                },
+                "port": {
+                    "type": "integer"
+                },
+                "scheme": {
+                    "type": "string"
+                }
+            }
+        },
+        "config.Token": {
+            "type": "object",
+            "properties": {
+                "addrs": {
+                    "description": "Addrs maps upstream hostnames to the address to connect to, overriding the proxy hosts config",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "policy": {
+                    "$ref": "#/definitions/config.Policy"
+                }
+            }
+        }
     }
 }`
 
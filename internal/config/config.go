@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -47,6 +48,46 @@ func (a *cfAction) UnmarshalText(b []byte) error {
 	return nil
 }
 
+// InsecureAction is the policy for plain http requests
+type InsecureAction int
+
+const (
+	InsecureAllow InsecureAction = iota
+	InsecureFlag
+	InsecureDeny
+)
+
+// MarshalText converts an insecure action to a string
+func (a InsecureAction) MarshalText() ([]byte, error) {
+	var s string
+	switch a {
+	default:
+		s = ""
+	case InsecureAllow:
+		s = "allow"
+	case InsecureFlag:
+		s = "flag"
+	case InsecureDeny:
+		s = "deny"
+	}
+	return []byte(s), nil
+}
+
+// UnmarshalText converts an insecure action from a string
+func (a *InsecureAction) UnmarshalText(b []byte) error {
+	switch strings.ToLower(string(b)) {
+	default:
+		return fmt.Errorf("unknown insecure value \"%s\"", b)
+	case "", "allow":
+		*a = InsecureAllow
+	case "flag":
+		*a = InsecureFlag
+	case "deny":
+		*a = InsecureDeny
+	}
+	return nil
+}
+
 type Config struct {
 	API     API            `json:"api"`
 	Proxy   Proxy          `json:"proxy"`
@@ -57,8 +98,67 @@ type API struct {
 	Addr string `json:"addr"`
 }
 type Proxy struct {
-	Addr    string   `json:"addr"`
-	Filters []Filter `json:"filters"`
+	Addr       string   `json:"addr"`
+	Filters    []Filter `json:"filters"`
+	RangeFull  bool     `json:"rangeFull"`  // record the full object for range requests, serving ranges from the cache
+	DecodeBody bool     `json:"decodeBody"` // store response bodies without a content encoding
+	// FollowRedirects is a list of host globs where redirects are followed by the proxy
+	FollowRedirects []string `json:"followRedirects"`
+	// CompleteOnAbort continues recording a download in the background when the client disconnects
+	CompleteOnAbort bool `json:"completeOnAbort"`
+	// Policy restricts the upstream requests for every token
+	Policy Policy `json:"policy"`
+	// UpstreamCA is a list of PEM files with CAs trusted for upstream connections in addition to the system roots
+	UpstreamCA []string `json:"upstreamCA"`
+	// Hosts configures the connection to specific upstream hosts
+	Hosts []Host `json:"hosts"`
+	// Rewrites map the urls of mirrors onto a canonical url, the first matching rule is used
+	Rewrites []Rewrite `json:"rewrites"`
+	// ReplayLatency delays responses from the cache by the recorded time to first byte
+	ReplayLatency bool `json:"replayLatency"`
+	// ReplayBandwidth limits responses from the cache to the recorded transfer rate
+	ReplayBandwidth bool `json:"replayBandwidth"`
+}
+
+// Rewrite replaces the url prefix of matching requests
+type Rewrite struct {
+	FromS     string   `json:"from"`
+	From      *url.URL `json:"-"`
+	ToS       string   `json:"to"` // url prefix used for the cache key
+	To        *url.URL `json:"-"`
+	UpstreamS string   `json:"upstream"` // url prefix used for the upstream request, defaults to the requested url
+	Upstream  *url.URL `json:"-"`
+}
+
+// Host configures the connection to upstream hosts matching a glob
+type Host struct {
+	Host        string `json:"host"`
+	TLSInsecure bool   `json:"tlsInsecure"` // skip verification of the upstream certificate
+	ClientCert  string `json:"clientCert"`  // PEM file with a client certificate for mTLS
+	ClientKey   string `json:"clientKey"`   // PEM file with the key of the client certificate
+	Addr        string `json:"addr"`        // address to connect to instead of resolving the host, the port is optional
+}
+
+// Policy restricts the upstream requests made by the proxy
+type Policy struct {
+	Allow []PolicyRule `json:"allow"` // when defined, requests must match an allow rule
+	Deny  []PolicyRule `json:"deny"`  // requests matching a deny rule are always rejected
+	// Insecure is the action for plain http requests: allow, flag, or deny
+	Insecure InsecureAction `json:"insecure" swaggertype:"string" enums:"allow,flag,deny"`
+}
+
+// PolicyRule matches requests, empty fields match any value
+type PolicyRule struct {
+	Host   string `json:"host"` // glob of the hostname, e.g. *.example.com
+	Scheme string `json:"scheme"`
+	Port   int    `json:"port"`
+}
+
+// Token is the configuration provided when creating a token
+type Token struct {
+	Policy Policy `json:"policy"`
+	// Addrs maps upstream hostnames to the address to connect to, overriding the proxy hosts config
+	Addrs map[string]string `json:"addrs"`
 }
 type Filter struct {
 	URLPrefixS string              `json:"urlPrefix"`
@@ -70,8 +170,30 @@ type Filter struct {
 	BodyForm   map[string]cfAction `json:"bodyForm"`
 }
 type Storage struct {
-	Kind      string `json:"kind"`
-	Directory string `json:"directory"`
+	Kind        string     `json:"kind"`
+	Directory   string     `json:"directory"`
+	Compression string     `json:"compression"` // compression of new blobs: gzip or zstd
+	Hash        string     `json:"hash"`        // hash algorithm of new blobs: sha256 (default), sha512, or blake3
+	Encryption  Encryption `json:"encryption"`
+	Verify      bool       `json:"verify"`      // rehash blobs read from the filesystem and bolt backends, failing reads of modified blobs, ranges hash the full blob first
+	MemoryLimit int64      `json:"memoryLimit"` // bytes of blobs held by memory storage, least recently used blobs spill to the directory or a temp dir
+	// tiered storage caches blobs from the remote storage in the local storage
+	Local        *Storage      `json:"local"`
+	Remote       *Storage      `json:"remote"`
+	WriteBack    bool          `json:"writeBack"`   // write blobs to local storage, copying them to remote storage on save or flush
+	CacheExpireS string        `json:"cacheExpire"` // duration, e.g. "24h", after which unused blobs are pruned from the local storage
+	CacheExpire  time.Duration `json:"-"`
+}
+
+// Encryption enables AES-GCM encryption of new blobs with the first key,
+// blobs record the id of the key used and any listed key may be used to read them
+type Encryption struct {
+	Keys []EncryptionKey `json:"keys"`
+}
+type EncryptionKey struct {
+	ID   string `json:"id"`
+	Key  string `json:"key"`  // base64 encoded 16, 24, or 32 byte key
+	File string `json:"file"` // file containing the base64 encoded key, used instead of key
 }
 
 type ConfigOpts struct {
@@ -131,6 +253,54 @@ func LoadReader(r io.Reader, c *Config) error {
 			c.Proxy.Filters[i].URLPrefix = u
 		}
 	}
+	for i, rw := range c.Proxy.Rewrites {
+		if rw.FromS == "" {
+			return fmt.Errorf("rewrite %d is missing the from url", i)
+		}
+		u, err := url.Parse(rw.FromS)
+		if err != nil {
+			return err
+		}
+		c.Proxy.Rewrites[i].From = u
+		if rw.ToS != "" {
+			u, err := url.Parse(rw.ToS)
+			if err != nil {
+				return err
+			}
+			c.Proxy.Rewrites[i].To = u
+		}
+		if rw.UpstreamS != "" {
+			u, err := url.Parse(rw.UpstreamS)
+			if err != nil {
+				return err
+			}
+			c.Proxy.Rewrites[i].Upstream = u
+		}
+	}
+	err = c.Storage.parse()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// parse durations in the storage config and any nested storage
+func (s *Storage) parse() error {
+	if s.CacheExpireS != "" {
+		d, err := time.ParseDuration(s.CacheExpireS)
+		if err != nil {
+			return fmt.Errorf("failed to parse cacheExpire: %w", err)
+		}
+		s.CacheExpire = d
+	}
+	for _, sub := range []*Storage{s.Local, s.Remote} {
+		if sub != nil {
+			err := sub.parse()
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
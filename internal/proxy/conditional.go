@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// conditionalHeaders are validators removed from requests so the full response is always recorded
+var conditionalHeaders = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// notModifiedHeaders are copied from the full response when returning a 304
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// isConditional returns true when the request includes validators that are handled by the proxy
+func isConditional(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, h := range conditionalHeaders {
+		if req.Header.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified returns true when the request validators match the full response
+func notModified(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	// If-Modified-Since is ignored when If-None-Match is provided
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagMatch(inm, resp.Header.Get("ETag"))
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	lm := resp.Header.Get("Last-Modified")
+	if ims == "" || lm == "" {
+		return false
+	}
+	imsTime, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	lmTime, err := http.ParseTime(lm)
+	if err != nil {
+		return false
+	}
+	return !lmTime.Truncate(time.Second).After(imsTime)
+}
+
+// etagMatch performs a weak comparison of an If-None-Match list against an ETag
+func etagMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, cur := range strings.Split(list, ",") {
+		cur = strings.TrimSpace(cur)
+		if cur == "*" || strings.TrimPrefix(cur, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified returns a 304 using the headers from the full response
+func writeNotModified(w http.ResponseWriter, header http.Header) {
+	wh := w.Header()
+	for _, h := range notModifiedHeaders {
+		if vv := header.Values(h); len(vv) > 0 {
+			wh[http.CanonicalHeaderKey(h)] = vv
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNotModified(t *testing.T) {
+	tests := []struct {
+		name       string
+		reqHeader  map[string]string
+		respCode   int
+		respHeader map[string]string
+		expect     bool
+	}{
+		{
+			name:       "etag match",
+			reqHeader:  map[string]string{"If-None-Match": `"abc"`},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"ETag": `"abc"`},
+			expect:     true,
+		},
+		{
+			name:       "etag list match",
+			reqHeader:  map[string]string{"If-None-Match": `"xyz", "abc"`},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"ETag": `"abc"`},
+			expect:     true,
+		},
+		{
+			name:       "etag weak match",
+			reqHeader:  map[string]string{"If-None-Match": `W/"abc"`},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"ETag": `"abc"`},
+			expect:     true,
+		},
+		{
+			name:       "etag wildcard",
+			reqHeader:  map[string]string{"If-None-Match": `*`},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"ETag": `"abc"`},
+			expect:     true,
+		},
+		{
+			name:       "etag mismatch",
+			reqHeader:  map[string]string{"If-None-Match": `"xyz"`},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"ETag": `"abc"`},
+			expect:     false,
+		},
+		{
+			name:       "etag missing",
+			reqHeader:  map[string]string{"If-None-Match": `"abc"`},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{},
+			expect:     false,
+		},
+		{
+			name: "etag mismatch ignores modified",
+			reqHeader: map[string]string{
+				"If-None-Match":     `"xyz"`,
+				"If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT",
+			},
+			respCode: http.StatusOK,
+			respHeader: map[string]string{
+				"ETag":          `"abc"`,
+				"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT",
+			},
+			expect: false,
+		},
+		{
+			name:       "modified same time",
+			reqHeader:  map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			expect:     true,
+		},
+		{
+			name:       "modified before",
+			reqHeader:  map[string]string{"If-Modified-Since": "Thu, 22 Oct 2015 07:28:00 GMT"},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			expect:     true,
+		},
+		{
+			name:       "modified after",
+			reqHeader:  map[string]string{"If-Modified-Since": "Tue, 20 Oct 2015 07:28:00 GMT"},
+			respCode:   http.StatusOK,
+			respHeader: map[string]string{"Last-Modified": "Wed, 21 Oct 2015 07:28:00 GMT"},
+			expect:     false,
+		},
+		{
+			name:       "not a full response",
+			reqHeader:  map[string]string{"If-None-Match": `"abc"`},
+			respCode:   http.StatusNotFound,
+			respHeader: map[string]string{"ETag": `"abc"`},
+			expect:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Method: http.MethodGet,
+				Header: http.Header{},
+			}
+			for k, v := range tt.reqHeader {
+				req.Header.Set(k, v)
+			}
+			resp := &http.Response{
+				StatusCode: tt.respCode,
+				Header:     http.Header{},
+			}
+			for k, v := range tt.respHeader {
+				resp.Header.Set(k, v)
+			}
+			if !isConditional(req) {
+				t.Errorf("request was not detected as conditional")
+			}
+			result := notModified(req, resp)
+			if result != tt.expect {
+				t.Errorf("unexpected result, expected %t, received %t", tt.expect, result)
+			}
+		})
+	}
+}
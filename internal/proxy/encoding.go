@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+type decodeFn func(io.Reader) (io.Reader, error)
+type encodeFn func(io.Writer) io.WriteCloser
+
+// contentDecoders are the content encodings that may be normalized in storage
+var contentDecoders = map[string]decodeFn{
+	"br": func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"x-gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// contentEncoders are used to re-encode a normalized body for the client
+var contentEncoders = map[string]encodeFn{
+	"br": func(w io.Writer) io.WriteCloser {
+		return brotli.NewWriter(w)
+	},
+	"deflate": func(w io.Writer) io.WriteCloser {
+		return zlib.NewWriter(w)
+	},
+	"gzip": func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+	"x-gzip": func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+}
+
+type decodeReadCloser struct {
+	body    io.ReadCloser
+	decode  decodeFn
+	decoder io.Reader
+}
+
+// Read initializes the decoder on the first read to handle empty bodies
+func (drc *decodeReadCloser) Read(p []byte) (int, error) {
+	if drc.decoder == nil {
+		d, err := drc.decode(drc.body)
+		if err != nil {
+			return 0, err
+		}
+		drc.decoder = d
+	}
+	return drc.decoder.Read(p)
+}
+
+// Close closes the decoder when supported and the original body
+func (drc *decodeReadCloser) Close() error {
+	if c, ok := drc.decoder.(io.Closer); ok {
+		c.Close()
+	}
+	return drc.body.Close()
+}
+
+// decodeResp replaces the response body with the decoded content and returns the original encoding,
+// an empty string is returned when the body is unchanged
+func decodeResp(resp *http.Response) string {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	decode, ok := contentDecoders[enc]
+	if !ok || len(resp.Header.Values("Content-Encoding")) > 1 {
+		return ""
+	}
+	resp.Body = &decodeReadCloser{
+		body:   resp.Body,
+		decode: decode,
+	}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	return enc
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header allows the encoding
+func acceptsEncoding(header http.Header, enc string) bool {
+	for _, list := range header.Values("Accept-Encoding") {
+		for _, entry := range strings.Split(list, ",") {
+			name, params, _ := strings.Cut(entry, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != enc && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if ok && strings.ToLower(k) == "q" {
+					if qParse, err := strconv.ParseFloat(v, 64); err == nil {
+						q = qParse
+					}
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// encodeWriter applies a content encoding to the response sent to the client
+type encodeWriter struct {
+	w   io.Writer
+	enc io.WriteCloser
+}
+
+// newEncodeWriter updates the response headers and returns a writer for the body,
+// an identity encoding is used when the client does not accept the original encoding
+func newEncodeWriter(w http.ResponseWriter, req *http.Request, resp *http.Response, enc string) *encodeWriter {
+	ew := &encodeWriter{w: w}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if encode, ok := contentEncoders[enc]; ok && acceptsEncoding(req.Header, enc) {
+		w.Header().Set("Content-Encoding", enc)
+		w.Header().Del("Content-Length")
+		ew.enc = encode(w)
+		return ew
+	}
+	// the length of the decoded body is known for cached responses
+	if sizer, ok := resp.Body.(interface{ Size() int64 }); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(sizer.Size(), 10))
+	}
+	return ew
+}
+
+func (ew *encodeWriter) Write(p []byte) (int, error) {
+	if ew.enc != nil {
+		return ew.enc.Write(p)
+	}
+	return ew.w.Write(p)
+}
+
+// Close flushes any remaining encoded data
+func (ew *encodeWriter) Close() error {
+	if ew.enc != nil {
+		return ew.enc.Close()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		enc    string
+		expect bool
+	}{
+		{name: "empty", accept: "", enc: "gzip", expect: false},
+		{name: "single", accept: "gzip", enc: "gzip", expect: true},
+		{name: "list", accept: "deflate, gzip, br", enc: "br", expect: true},
+		{name: "missing", accept: "deflate, br", enc: "gzip", expect: false},
+		{name: "wildcard", accept: "*", enc: "gzip", expect: true},
+		{name: "q zero", accept: "gzip;q=0, identity", enc: "gzip", expect: false},
+		{name: "q value", accept: "gzip; q=0.5", enc: "gzip", expect: true},
+		{name: "case", accept: "GZIP", enc: "gzip", expect: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.accept != "" {
+				h.Set("Accept-Encoding", tt.accept)
+			}
+			result := acceptsEncoding(h, tt.enc)
+			if result != tt.expect {
+				t.Errorf("unexpected result, expected %t, received %t", tt.expect, result)
+			}
+		})
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	content := []byte("hello world, hello world, hello world")
+	for enc, encode := range contentEncoders {
+		t.Run(enc, func(t *testing.T) {
+			encBuf := &bytes.Buffer{}
+			ew := encode(encBuf)
+			_, err := ew.Write(content)
+			if err != nil {
+				t.Errorf("failed to encode: %v", err)
+				return
+			}
+			err = ew.Close()
+			if err != nil {
+				t.Errorf("failed to close encoder: %v", err)
+				return
+			}
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       io.NopCloser(bytes.NewReader(encBuf.Bytes())),
+			}
+			resp.Header.Set("Content-Encoding", enc)
+			if decodeResp(resp) != enc {
+				t.Errorf("decoding was not applied")
+				return
+			}
+			if resp.Header.Get("Content-Encoding") != "" {
+				t.Errorf("content encoding header was not removed")
+			}
+			decoded, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("failed to decode: %v", err)
+				return
+			}
+			if !bytes.Equal(decoded, content) {
+				t.Errorf("decoded mismatch, expected %s, received %s", content, decoded)
+			}
+			// re-encode for a client that accepts the original encoding
+			req := &http.Request{Header: http.Header{}}
+			req.Header.Set("Accept-Encoding", enc)
+			resp.Body = io.NopCloser(bytes.NewReader(decoded))
+			w := httptest.NewRecorder()
+			ew2 := newEncodeWriter(w, req, resp, enc)
+			_, err = io.Copy(ew2, resp.Body)
+			if err != nil {
+				t.Errorf("failed to write encoded response: %v", err)
+			}
+			ew2.Close()
+			if w.Header().Get("Content-Encoding") != enc {
+				t.Errorf("content encoding mismatch, expected %s, received %s", enc, w.Header().Get("Content-Encoding"))
+			}
+			resp.Header.Set("Content-Encoding", enc)
+			resp.Body = io.NopCloser(w.Body)
+			decodeResp(resp)
+			decoded, err = io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("failed to decode: %v", err)
+				return
+			}
+			if !bytes.Equal(decoded, content) {
+				t.Errorf("re-encoded mismatch, expected %s, received %s", content, decoded)
+			}
+		})
+	}
+	t.Run("empty", func(t *testing.T) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+		}
+		resp.Header.Set("Content-Encoding", "gzip")
+		decodeResp(resp)
+		decoded, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("failed to read empty body: %v", err)
+		}
+		if len(decoded) != 0 {
+			t.Errorf("unexpected content: %s", decoded)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/httplock/httplock/internal/storage"
+)
+
+// flightGroup coalesces identical requests within a root so only one is sent upstream
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+type flightKey struct {
+	root *storage.Root
+	key  string
+}
+
+// flight is a request sent upstream, waiters are released when the leader finishes recording
+type flight struct {
+	done   chan struct{}
+	err    error
+	once   sync.Once
+	remove func()
+}
+
+// join returns the flight for a request and true when the caller is the leader,
+// the leader sends the request upstream and must call finish when the response is recorded
+func (g *flightGroup) join(root *storage.Root, key string) (*flight, bool) {
+	fk := flightKey{root: root, key: key}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[fk]; ok {
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = map[flightKey]*flight{}
+	}
+	f := &flight{
+		done: make(chan struct{}),
+	}
+	f.remove = func() {
+		g.mu.Lock()
+		delete(g.flights, fk)
+		g.mu.Unlock()
+	}
+	g.flights[fk] = f
+	return f, true
+}
+
+// finish releases any waiters, an error is returned to the waiters when the upstream request failed,
+// only the first call is used
+func (f *flight) finish(err error) {
+	if f == nil {
+		return
+	}
+	f.once.Do(func() {
+		f.remove()
+		f.err = err
+		close(f.done)
+	})
+}
+
+// wait blocks until the leader finishes, returning the error from the leader
+func (f *flight) wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
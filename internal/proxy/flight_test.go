@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/httplock/httplock/internal/storage"
+)
+
+func TestFlight(t *testing.T) {
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, root1, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	_, root2, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	ctx := context.Background()
+	g := flightGroup{}
+
+	f1, leader := g.join(root1, "key")
+	if !leader {
+		t.Errorf("first request did not lead")
+		return
+	}
+	f2, leader := g.join(root1, "key")
+	if leader || f2 != f1 {
+		t.Errorf("second request did not join the existing flight")
+		return
+	}
+	f3, leader := g.join(root2, "key")
+	if !leader {
+		t.Errorf("request in a different root did not lead")
+		return
+	}
+	f3.finish(nil)
+	select {
+	case <-f2.done:
+		t.Errorf("flight finished before the leader")
+	default:
+	}
+	f1.finish(nil)
+	f1.finish(errors.New("ignored")) // only the first finish is used
+	if err := f2.wait(ctx); err != nil {
+		t.Errorf("unexpected error from wait: %v", err)
+	}
+
+	// errors from the leader are shared with waiters
+	errUpstream := errors.New("upstream failed")
+	f4, leader := g.join(root1, "key")
+	if !leader {
+		t.Errorf("request after flight finished did not lead")
+		return
+	}
+	f5, _ := g.join(root1, "key")
+	f4.finish(errUpstream)
+	if err := f5.wait(ctx); !errors.Is(err, errUpstream) {
+		t.Errorf("unexpected error from wait, expected %v, received %v", errUpstream, err)
+	}
+
+	// waiters stop when their context is done
+	f6, _ := g.join(root1, "key")
+	f7, _ := g.join(root1, "key")
+	ctxCancel, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := f7.wait(ctxCancel); !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from canceled wait: %v", err)
+	}
+	f6.finish(nil)
+}
+
+func TestFlightServe(t *testing.T) {
+	hits := atomic.Int32{}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer ts.Close()
+	c, err := config.New(config.ConfigOpts{})
+	if err != nil {
+		t.Errorf("failed to create config: %v", err)
+		return
+	}
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, root, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	p := proxy{conf: c, storage: s}
+	count := 5
+	recorders := make([]*httptest.ResponseRecorder, count)
+	wg := sync.WaitGroup{}
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+			p.serveWithCache(w, req, root)
+		}(recorders[i])
+		if i == 0 {
+			// the remaining requests wait on the leader
+			<-started
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if hits.Load() != 1 {
+		t.Errorf("expected 1 upstream request, received %d", hits.Load())
+	}
+	for i, w := range recorders {
+		if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+			t.Errorf("unexpected response %d, %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+}
+
+// abortRecorder fails every write to the body as if the client disconnected
+type abortRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (ar abortRecorder) Write(p []byte) (int, error) {
+	return 0, errors.New("client disconnected")
+}
+
+func TestFlightAbort(t *testing.T) {
+	tests := []struct {
+		name            string
+		completeOnAbort bool
+		expectHits      int32
+	}{
+		{
+			// the partial response is not recorded, the next request is sent upstream
+			name:       "discard",
+			expectHits: 2,
+		},
+		{
+			// the download finishes in the background, the next request is replayed
+			name:            "complete",
+			completeOnAbort: true,
+			expectHits:      1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits := atomic.Int32{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				// the client aborts after the first part of the body
+				_, _ = w.Write([]byte("01234"))
+				w.(http.Flusher).Flush()
+				time.Sleep(20 * time.Millisecond)
+				_, _ = w.Write([]byte("56789"))
+			}))
+			defer ts.Close()
+			c, err := config.New(config.ConfigOpts{})
+			if err != nil {
+				t.Errorf("failed to create config: %v", err)
+				return
+			}
+			c.Proxy.CompleteOnAbort = tt.completeOnAbort
+			s, err := storage.NewMemory()
+			if err != nil {
+				t.Errorf("failed setting up storage: %v", err)
+				return
+			}
+			_, root, err := s.RootCreate()
+			if err != nil {
+				t.Errorf("failed setting up root: %v", err)
+				return
+			}
+			p := proxy{conf: c, storage: s}
+			req := httptest.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+			p.serveWithCache(abortRecorder{httptest.NewRecorder()}, req, root)
+			req = httptest.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+			w := httptest.NewRecorder()
+			p.serveWithCache(w, req, root)
+			if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+				t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+			}
+			if hits.Load() != tt.expectHits {
+				t.Errorf("expected %d upstream requests, received %d", tt.expectHits, hits.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/httplock/httplock/internal/storage"
+	"github.com/sirupsen/logrus"
+)
+
+var errPolicyDenied = errors.New("denied by policy")
+
+// policyCtxKey is used to check redirects followed by the proxy against the policies of the token
+type policyCtxKey struct{}
+
+type policyCheckFn func(req *http.Request) error
+
+// policyCheck returns an error when any of the policies deny a request to the url
+func policyCheck(u *url.URL, policies ...config.Policy) error {
+	scheme := strings.ToLower(u.Scheme)
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		switch scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	for _, pol := range policies {
+		for _, rule := range pol.Deny {
+			if policyMatch(rule, scheme, host, port) {
+				return fmt.Errorf("%w: %s matches deny rule host=%s scheme=%s port=%d", errPolicyDenied, u.Host, rule.Host, rule.Scheme, rule.Port)
+			}
+		}
+		if len(pol.Allow) == 0 {
+			continue
+		}
+		allowed := false
+		for _, rule := range pol.Allow {
+			if policyMatch(rule, scheme, host, port) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s does not match an allow rule", errPolicyDenied, u.Host)
+		}
+	}
+	return nil
+}
+
+func policyMatch(rule config.PolicyRule, scheme, host, port string) bool {
+	return (rule.Host == "" || hostMatch(rule.Host, host)) &&
+		(rule.Scheme == "" || strings.EqualFold(rule.Scheme, scheme)) &&
+		(rule.Port == 0 || strconv.Itoa(rule.Port) == port)
+}
+
+// policyInsecure returns the strictest action for plain http requests from the policies
+func policyInsecure(policies ...config.Policy) config.InsecureAction {
+	action := config.InsecureAllow
+	for _, pol := range policies {
+		if pol.Insecure > action {
+			action = pol.Insecure
+		}
+	}
+	return action
+}
+
+// policyAllow checks a request against the config and token policies, violations are recorded in the root
+func (p *proxy) policyAllow(method string, u *url.URL, root *storage.Root) error {
+	policies := []config.Policy{p.conf.Proxy.Policy, root.Conf().Policy}
+	err := policyCheck(u, policies...)
+	if err == nil && strings.EqualFold(u.Scheme, "http") {
+		switch policyInsecure(policies...) {
+		case config.InsecureDeny:
+			err = fmt.Errorf("%w: insecure request", errPolicyDenied)
+		case config.InsecureFlag:
+			// flagged requests are allowed but recorded for review
+			p.policyRecord(method, u, "insecure request", root)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	p.conf.Log.WithFields(logrus.Fields{
+		"method": method,
+		"url":    u.String(),
+		"err":    err,
+	}).Warn("policy violation")
+	p.policyRecord(method, u, err.Error(), root)
+	return err
+}
+
+// policyRecord adds an entry to the root for a request matching a policy
+func (p *proxy) policyRecord(method string, u *url.URL, reason string, root *storage.Root) {
+	if root.ReadOnly() {
+		return
+	}
+	err := storagePutPolicy(method, u, reason, root)
+	if err != nil {
+		p.conf.Log.Warnf("failed to record policy violation: %v", err)
+	}
+}
+
+// policyContext adds a check of redirects followed by the proxy
+func (p *proxy) policyContext(ctx context.Context, root *storage.Root) context.Context {
+	return context.WithValue(ctx, policyCtxKey{}, policyCheckFn(func(req *http.Request) error {
+		return p.policyAllow(req.Method, req.URL, root)
+	}))
+}
+
+// policyRedirect checks a redirect against the policy saved in the request context
+func policyRedirect(req *http.Request) error {
+	if check, ok := req.Context().Value(policyCtxKey{}).(policyCheckFn); ok {
+		return check(req)
+	}
+	return nil
+}
+
+func policyDeny(w http.ResponseWriter) {
+	http.Error(w, "request denied by policy", http.StatusForbidden)
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/httplock/httplock/internal/config"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	polConf := config.Policy{
+		Deny: []config.PolicyRule{
+			{Host: "*.evil.example.com"},
+			{Host: "example.com", Port: 8080},
+		},
+	}
+	polToken := config.Policy{
+		Allow: []config.PolicyRule{
+			{Host: "example.com", Scheme: "https"},
+			{Host: "*.example.org"},
+		},
+	}
+	tests := []struct {
+		name     string
+		url      string
+		policies []config.Policy
+		expectOK bool
+	}{
+		{
+			name:     "no policy",
+			url:      "http://anywhere.example.net/",
+			expectOK: true,
+		},
+		{
+			name:     "empty policy",
+			url:      "http://anywhere.example.net/",
+			policies: []config.Policy{{}},
+			expectOK: true,
+		},
+		{
+			name:     "deny host glob",
+			url:      "https://data.evil.example.com/upload",
+			policies: []config.Policy{polConf},
+		},
+		{
+			name:     "deny host uppercase",
+			url:      "https://DATA.EVIL.example.com/upload",
+			policies: []config.Policy{polConf},
+		},
+		{
+			name:     "deny port",
+			url:      "http://example.com:8080/",
+			policies: []config.Policy{polConf},
+		},
+		{
+			name:     "other port",
+			url:      "http://example.com/",
+			policies: []config.Policy{polConf},
+			expectOK: true,
+		},
+		{
+			name:     "allow scheme",
+			url:      "https://example.com/",
+			policies: []config.Policy{polConf, polToken},
+			expectOK: true,
+		},
+		{
+			name:     "allow wrong scheme",
+			url:      "http://example.com/",
+			policies: []config.Policy{polConf, polToken},
+		},
+		{
+			name:     "allow glob",
+			url:      "http://www.example.org/",
+			policies: []config.Policy{polConf, polToken},
+			expectOK: true,
+		},
+		{
+			name:     "not allowed",
+			url:      "https://example.net/",
+			policies: []config.Policy{polConf, polToken},
+		},
+		{
+			name:     "allowed but denied port",
+			url:      "https://example.com:8080/",
+			policies: []config.Policy{polConf, polToken},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Errorf("failed to parse url: %v", err)
+				return
+			}
+			err = policyCheck(u, tt.policies...)
+			if tt.expectOK && err != nil {
+				t.Errorf("unexpected denial: %v", err)
+			} else if !tt.expectOK && !errors.Is(err, errPolicyDenied) {
+				t.Errorf("request was not denied: %v", err)
+			}
+		})
+	}
+}
+
+func TestPolicyInsecure(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []config.Policy
+		expect   config.InsecureAction
+	}{
+		{
+			name:   "default",
+			expect: config.InsecureAllow,
+		},
+		{
+			name:     "token flag",
+			policies: []config.Policy{{}, {Insecure: config.InsecureFlag}},
+			expect:   config.InsecureFlag,
+		},
+		{
+			name:     "config deny",
+			policies: []config.Policy{{Insecure: config.InsecureDeny}, {Insecure: config.InsecureFlag}},
+			expect:   config.InsecureDeny,
+		},
+		{
+			name:     "token deny",
+			policies: []config.Policy{{Insecure: config.InsecureFlag}, {Insecure: config.InsecureDeny}},
+			expect:   config.InsecureDeny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := policyInsecure(tt.policies...)
+			if result != tt.expect {
+				t.Errorf("unexpected action, expected %d, received %d", tt.expect, result)
+			}
+		})
+	}
+}
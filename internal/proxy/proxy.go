@@ -2,14 +2,19 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/httplock/httplock/internal/cert"
 	"github.com/httplock/httplock/internal/config"
@@ -27,24 +32,34 @@ type proxyConnect struct {
 }
 
 type proxy struct {
-	conf    config.Config
-	certs   *cert.Cert
-	storage storage.Storage
-	client  *http.Client
+	conf         config.Config
+	certs        *cert.Cert
+	storage      storage.Storage
+	client       *http.Client
+	clientFollow *http.Client
+	upstream     *upstreamTransport
+	flights      flightGroup
 }
 
 // Start creates a new proxy service
 func Start(conf config.Config, s storage.Storage, certs *cert.Cert) (*http.Server, error) {
+	ut, err := newUpstreamTransport(conf.Proxy)
+	if err != nil {
+		return nil, err
+	}
 	pe := proxy{
 		conf:    conf,
 		certs:   certs,
 		storage: s,
 		client: &http.Client{
+			Transport: ut,
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				return http.ErrUseLastResponse
 			},
 			Timeout: 0, // TODO: determine more appropriate Timeout, configurable?
 		},
+		clientFollow: newClientFollow(ut),
+		upstream:     ut,
 	}
 	ph := proxyHTTP{
 		p: &pe,
@@ -88,7 +103,11 @@ func copyHeader(dst, src http.Header) {
 }
 
 func delHopHeaders(header http.Header) {
-	for _, h := range hopHeaders {
+	delHeaders(header, hopHeaders)
+}
+
+func delHeaders(header http.Header, names []string) {
+	for _, h := range names {
 		header.Del(h)
 	}
 }
@@ -138,14 +157,72 @@ func (p *proxy) serveWithCache(w http.ResponseWriter, req *http.Request, root *s
 		}).Warn("serveWithCache: failed stripping req headers")
 	}
 
+	p.rewriteReq(reqStore, reqDo)
+
+	// policies apply to the upstream url after any rewrite
+	if err := p.policyAllow(req.Method, reqDo.URL, root); err != nil {
+		policyDeny(w)
+		return
+	}
+
 	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
 		appendHostToXForwardHeader(req.Header, clientIP)
 	}
 
+	// range requests may be recorded as the full object
+	rangeFull := p.isRangeFull(req)
+	if rangeFull {
+		delHeaders(reqStore.Header, rangeHeaders)
+		delHeaders(reqDo.Header, rangeHeaders)
+	}
+	// validators are handled by the proxy, the full response is always recorded
+	conditional := isConditional(req)
+	if conditional {
+		delHeaders(reqStore.Header, conditionalHeaders)
+		delHeaders(reqDo.Header, conditionalHeaders)
+	}
+
+	// decoded bodies are stored independent of the encodings accepted by the client
+	if p.conf.Proxy.DecodeBody {
+		reqStore.Header.Del("Accept-Encoding")
+	}
+	contentEnc := ""
+
 	// check if content is in cache
-	resp, err := storageGetResp(reqStore, p.storage, root)
-	if err == nil {
+	resp, metaResp, err := storageGetResp(reqStore, p.storage, root)
+	// only responses recorded before this request are replayed with the recorded timing,
+	// coalesced requests and full range downloads have already waited on upstream
+	replayed := err == nil
+	var f *flight
+	for err != nil && !root.ReadOnly() {
+		// identical requests are coalesced so only one is sent upstream
+		key, errKey := storageGenKey(reqStore, p.storage, root)
+		if errKey != nil {
+			p.conf.Log.Printf("serveWithCache: failed to generate key: %v", errKey)
+			break
+		}
+		var leader bool
+		f, leader = p.flights.join(root, key)
+		if leader {
+			break
+		}
+		err = f.wait(req.Context())
+		f = nil
+		if req.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Server Error", http.StatusBadGateway)
+			p.conf.Log.Printf("serveWithCache: coalesced request failed: %v", err)
+			return
+		}
+		// the leader may not have finished recording when the client aborted
+		resp, metaResp, err = storageGetResp(reqStore, p.storage, root)
+	}
+	cacheHit := err == nil
+	if cacheHit {
 		p.conf.Log.Println("Cache hit")
+		contentEnc = metaResp.ContentEncoding
 	}
 	if err != nil {
 		p.conf.Log.Printf("Cache miss req: %s, %v", reqStore.URL.String(), err)
@@ -156,37 +233,151 @@ func (p *proxy) serveWithCache(w http.ResponseWriter, req *http.Request, root *s
 			w.Write([]byte("httplock is readonly"))
 			return
 		}
-
 		if p.client == nil {
 			p.client = &http.Client{}
 		}
 
 		reqDo.Body = reqStore.Body
 		reqDo.GetBody = reqStore.GetBody
-		resp, err = p.client.Do(reqDo)
+		// the download is not tied to the client connection when it continues after an abort
+		ctx := reqDo.Context()
+		if p.conf.Proxy.CompleteOnAbort {
+			ctx = context.Background()
+		}
+		ctx = p.policyContext(ctx, root)
+		ctx = upstreamContext(ctx, root.Conf())
+		// informational responses are forwarded to the client as they are received
+		rt := &respTrace{start: time.Now()}
+		reqDo = reqDo.WithContext(httptrace.WithClientTrace(ctx, rt.clientTrace(w)))
+		resp, err = p.upstreamClient(reqDo).Do(reqDo)
 		if err != nil {
+			f.finish(err)
+			if errors.Is(err, errPolicyDenied) {
+				// a redirect was rejected
+				policyDeny(w)
+				return
+			}
 			http.Error(w, "Server Error", http.StatusInternalServerError)
 			p.conf.Log.Printf("serveWithCache: client.Do failed: %v", err)
 			// TODO: cache connection failed errors?
 			return
 		}
+		// the identity is from the final host when redirects were followed
+		rt.identity = p.upstream.clientIdentity(resp)
 		// TODO: strip response headers
+		if p.conf.Proxy.DecodeBody {
+			rt.encoding = decodeResp(resp)
+			contentEnc = rt.encoding
+		}
 
 		// store result in cache
-		err = storagePutResp(reqStore, resp, p.storage, root)
+		err = storagePutResp(reqStore, resp, rt, p.storage, root)
 		if err != nil {
 			p.conf.Log.Printf("Error on storagePutResp: %v\n", err)
 		}
+		// waiting requests are released after the recording is finished
+		resp.Body = newCloseNotifyRC(resp.Body, func() { f.finish(nil) })
+
+		if rangeFull {
+			// finish recording the full object and then serve the range from the cache
+			_, err = io.Copy(io.Discard, resp.Body)
+			if err != nil {
+				f.finish(err)
+			}
+			resp.Body.Close()
+			if err != nil {
+				http.Error(w, "Server Error", http.StatusBadGateway)
+				p.conf.Log.Printf("serveWithCache: failed to read full object for range: %v", err)
+				return
+			}
+			resp, metaResp, err = storageGetResp(reqStore, p.storage, root)
+			if err != nil {
+				http.Error(w, "Server Error", http.StatusInternalServerError)
+				p.conf.Log.Printf("serveWithCache: failed to load full object for range: %v", err)
+				return
+			}
+			// informational responses were already forwarded by the trace
+			metaResp.Informational = nil
+			cacheHit = true
+		}
 	}
-	defer resp.Body.Close()
+	closeBody := true
+	defer func() {
+		if closeBody {
+			resp.Body.Close()
+		}
+	}()
 
 	p.conf.Log.Println(req.RemoteAddr, " ", resp.Status)
 
 	delHopHeaders(resp.Header)
 
+	if replayed && p.conf.Proxy.ReplayLatency && metaResp.Timing != nil {
+		if err := sleepCtx(req.Context(), metaResp.Timing.TTFB); err != nil {
+			return
+		}
+	}
+
+	if conditional && notModified(req, resp) {
+		if !cacheHit {
+			// finish recording the full response that is not sent to the client
+			_, err = io.Copy(io.Discard, resp.Body)
+			if err != nil {
+				p.conf.Log.Printf("serveWithCache: failed to read response: %v", err)
+			}
+		}
+		writeNotModified(w, resp.Header)
+		return
+	}
+	if rangeFull && serveRange(w, req, resp) {
+		return
+	}
+
+	if metaResp != nil {
+		for _, info := range metaResp.Informational {
+			writeInformational(w, info.StatusCode, info.Headers)
+		}
+	}
 	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	announceTrailers(w, resp.Trailer)
+	cw := &errWriter{w: w}
+	var body io.Reader = resp.Body
+	if replayed && p.conf.Proxy.ReplayBandwidth && metaResp.Timing.rate() > 0 {
+		body = newThrottleReader(req.Context(), resp.Body, metaResp.Timing.rate())
+	}
+	if contentEnc != "" {
+		ew := newEncodeWriter(w, req, resp, contentEnc)
+		cw.w = ew
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(cw, body)
+		ew.Close()
+	} else {
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(cw, body)
+	}
+	if err != nil && cw.err == nil && !cacheHit {
+		// failures reading from upstream are returned to any waiting requests
+		f.finish(err)
+	}
+	if err != nil && cw.err == nil && cacheHit {
+		// abort the connection rather than finishing a truncated or modified response, e.g. storage.ErrHashMismatch
+		p.conf.Log.Printf("serveWithCache: failed to read cached response for %s: %v", reqStore.URL.String(), err)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil && cw.err != nil && !cacheHit && p.conf.Proxy.CompleteOnAbort {
+		// client disconnected, finish the download in the background to record the response
+		p.conf.Log.Printf("serveWithCache: client aborted, completing download of %s", reqStore.URL.String())
+		closeBody = false
+		go func(body io.ReadCloser) {
+			_, err := io.Copy(io.Discard, body)
+			if err != nil {
+				p.conf.Log.Printf("serveWithCache: background download failed: %v", err)
+			}
+			body.Close()
+		}(resp.Body)
+		return
+	}
+	writeTrailers(w, resp.Trailer)
 }
 
 func (p *proxy) getAuth(req *http.Request) (*storage.Root, error) {
@@ -217,7 +408,7 @@ func (p *proxy) filterReq(req *http.Request) (*http.Request, *http.Request, erro
 	reqStrip.URL = &uStrip
 	reqIgnore.Header = req.Header.Clone()
 	uIgnore := *req.URL
-	reqStrip.URL = &uIgnore
+	reqIgnore.URL = &uIgnore
 	for _, f := range p.conf.Proxy.Filters {
 		if (f.Method == "" || f.Method == req.Method) &&
 			(f.URLPrefix == nil || (f.URLPrefix != nil &&
@@ -285,6 +476,10 @@ func (ph *proxyHTTP) handleConnect(w http.ResponseWriter, req *http.Request) {
 		requireAuthBasic(w)
 		return
 	}
+	if err := ph.p.policyAllow(req.Method, &url.URL{Scheme: "https", Host: req.Host}, root); err != nil {
+		policyDeny(w)
+		return
+	}
 
 	// identify remote host and generate a tls certificate for that host
 	name, _, err := net.SplitHostPort(req.Host)
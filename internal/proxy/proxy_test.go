@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/httplock/httplock/internal/config"
+)
+
+func TestFilterReq(t *testing.T) {
+	conf := `{"proxy": {"filters": [
+		{"urlPrefix": "https://example.com/", "reqHeader": {"X-Strip": "strip", "X-Ignore": "ignore"}, "reqQuery": {"strip": "strip", "ignore": "ignore"}}
+	]}}`
+	c := config.Config{}
+	err := config.LoadReader(strings.NewReader(conf), &c)
+	if err != nil {
+		t.Errorf("failed to load config: %v", err)
+		return
+	}
+	p := proxy{conf: c}
+
+	tests := []struct {
+		name         string
+		url          string
+		expectIgnore string
+		expectStrip  string
+		ignoreHeader bool
+	}{
+		{
+			name:         "no match",
+			url:          "https://other.example.com/a?strip=1&ignore=2&keep=3",
+			expectIgnore: "https://other.example.com/a?strip=1&ignore=2&keep=3",
+			expectStrip:  "https://other.example.com/a?strip=1&ignore=2&keep=3",
+		},
+		{
+			name:         "match",
+			url:          "https://example.com/a?strip=1&ignore=2&keep=3",
+			expectIgnore: "https://example.com/a?keep=3",
+			expectStrip:  "https://example.com/a?ignore=2&keep=3",
+			ignoreHeader: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+				return
+			}
+			req.Header.Set("X-Strip", "strip")
+			req.Header.Set("X-Ignore", "ignore")
+			reqIgnore, reqStrip, err := p.filterReq(req)
+			if err != nil {
+				t.Errorf("failed to filter request: %v", err)
+				return
+			}
+			if reqIgnore.URL.String() != tt.expectIgnore {
+				t.Errorf("unexpected ignore url, expected %s, received %s", tt.expectIgnore, reqIgnore.URL.String())
+			}
+			if reqStrip.URL.String() != tt.expectStrip {
+				t.Errorf("unexpected strip url, expected %s, received %s", tt.expectStrip, reqStrip.URL.String())
+			}
+			if req.URL.String() != tt.url {
+				t.Errorf("original request modified to %s", req.URL.String())
+			}
+			if (reqIgnore.Header.Get("X-Ignore") == "") != tt.ignoreHeader || (reqIgnore.Header.Get("X-Strip") == "") != tt.ignoreHeader {
+				t.Errorf("unexpected ignore headers: %v", reqIgnore.Header)
+			}
+			if reqStrip.Header.Get("X-Ignore") == "" || (reqStrip.Header.Get("X-Strip") == "") != tt.ignoreHeader {
+				t.Errorf("unexpected strip headers: %v", reqStrip.Header)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// rangeHeaders are removed from the request when the full object is fetched
+var rangeHeaders = []string{
+	"Range",
+	"If-Range",
+}
+
+// isRangeFull returns true when a range request should be handled from the full object
+func (p *proxy) isRangeFull(req *http.Request) bool {
+	return p.conf.Proxy.RangeFull &&
+		req.Method == http.MethodGet &&
+		req.Header.Get("Range") != ""
+}
+
+// serveRange returns the requested range from a full response body,
+// false is returned when the response cannot be used and nothing was written
+func serveRange(w http.ResponseWriter, req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK {
+		return false
+	}
+	rs, ok := resp.Body.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+	copyHeader(w.Header(), resp.Header)
+	// the length is set by ServeContent for the returned range
+	w.Header().Del("Content-Length")
+	http.ServeContent(w, req, "", time.Time{}, rs)
+	return true
+}
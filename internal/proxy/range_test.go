@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/httplock/httplock/internal/storage"
+)
+
+func TestRange(t *testing.T) {
+	reqURL, _ := url.Parse("http://example.com/file.tgz")
+	req := http.Request{
+		Method:     "GET",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		URL:        reqURL,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+	}
+	respBodyText := []byte("0123456789abcdefghij")
+	resp := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(respBodyText)),
+	}
+	resp.Header.Add("Content-Type", "application/octet-stream")
+	resp.ContentLength = int64(len(respBodyText))
+
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, root, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	err = storagePutResp(&req, &resp, nil, s, root)
+	if err != nil {
+		t.Errorf("failed to put response in cache: %v", err)
+		return
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("failed to read resp: %v", err)
+	}
+	resp.Body.Close()
+
+	tests := []struct {
+		name        string
+		rangeHeader string
+		expectCode  int
+		expectRange string
+		expectBody  []byte
+	}{
+		{
+			name:        "start",
+			rangeHeader: "bytes=0-4",
+			expectCode:  http.StatusPartialContent,
+			expectRange: "bytes 0-4/20",
+			expectBody:  respBodyText[0:5],
+		},
+		{
+			name:        "middle",
+			rangeHeader: "bytes=10-14",
+			expectCode:  http.StatusPartialContent,
+			expectRange: "bytes 10-14/20",
+			expectBody:  respBodyText[10:15],
+		},
+		{
+			name:        "suffix",
+			rangeHeader: "bytes=-3",
+			expectCode:  http.StatusPartialContent,
+			expectRange: "bytes 17-19/20",
+			expectBody:  respBodyText[17:],
+		},
+		{
+			name:        "unsatisfiable",
+			rangeHeader: "bytes=30-40",
+			expectCode:  http.StatusRequestedRangeNotSatisfiable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getResp, _, err := storageGetResp(&req, s, root)
+			if err != nil {
+				t.Errorf("failed to retrieve response: %v", err)
+				return
+			}
+			defer getResp.Body.Close()
+			rangeReq := req.Clone(req.Context())
+			rangeReq.Header.Set("Range", tt.rangeHeader)
+			w := httptest.NewRecorder()
+			if !serveRange(w, rangeReq, getResp) {
+				t.Errorf("range was not served")
+				return
+			}
+			if w.Code != tt.expectCode {
+				t.Errorf("status mismatch, expected %d, received %d", tt.expectCode, w.Code)
+			}
+			if tt.expectRange != "" && w.Header().Get("Content-Range") != tt.expectRange {
+				t.Errorf("content range mismatch, expected %s, received %s", tt.expectRange, w.Header().Get("Content-Range"))
+			}
+			if tt.expectBody != nil && !bytes.Equal(w.Body.Bytes(), tt.expectBody) {
+				t.Errorf("body mismatch, expected %s, received %s", tt.expectBody, w.Body.Bytes())
+			}
+		})
+	}
+}
+
+// infoRecorder counts the informational responses written to the client
+type infoRecorder struct {
+	*httptest.ResponseRecorder
+	info []int
+}
+
+func (ir *infoRecorder) WriteHeader(code int) {
+	if code >= 100 && code < 200 {
+		ir.info = append(ir.info, code)
+		return
+	}
+	ir.ResponseRecorder.WriteHeader(code)
+}
+
+func TestRangeFullInformational(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("not found"))
+	}))
+	defer ts.Close()
+	c, err := config.New(config.ConfigOpts{})
+	if err != nil {
+		t.Errorf("failed to create config: %v", err)
+		return
+	}
+	c.Proxy.RangeFull = true
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, root, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	p := proxy{conf: c, storage: s}
+	// the miss forwards the hint live, the replay sends it from the recording
+	for _, name := range []string{"miss", "replay"} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+			req.Header.Set("Range", "bytes=2-4")
+			w := &infoRecorder{ResponseRecorder: httptest.NewRecorder()}
+			p.serveWithCache(w, req, root)
+			if w.Code != http.StatusNotFound {
+				t.Errorf("unexpected status %d", w.Code)
+			}
+			if len(w.info) != 1 || w.info[0] != http.StatusEarlyHints {
+				t.Errorf("expected one early hint, received %v", w.info)
+			}
+		})
+	}
+}
@@ -1,34 +1,46 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 )
 
 type teeReadCloser struct {
-	io.Reader
-	r  io.ReadCloser
-	w  io.WriteCloser
-	cb func() error
+	tr  io.Reader
+	r   io.ReadCloser
+	w   io.WriteCloser
+	cb  func() error
+	eof bool
 }
 
 // wrap a tee reader to handle Closer variants
+// cb is only run on close after the full body has been read
 func newTeeRC(r io.ReadCloser, w io.WriteCloser, cb func() error) io.ReadCloser {
 	tr := io.TeeReader(r, w)
 	trc := teeReadCloser{
-		Reader: tr,
-		r:      r,
-		w:      w,
-		cb:     cb,
+		tr: tr,
+		r:  r,
+		w:  w,
+		cb: cb,
 	}
 	return &trc
 }
 
+// Read passes through the read request, tracking when the end of the body is reached
+func (trc *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := trc.tr.Read(p)
+	if errors.Is(err, io.EOF) {
+		trc.eof = true
+	}
+	return n, err
+}
+
 // pass through close requests
 func (trc *teeReadCloser) Close() error {
 	errs := []error{}
 	errs = append(errs, trc.r.Close())
 	errs = append(errs, trc.w.Close())
-	if trc.cb != nil {
+	if trc.cb != nil && trc.eof {
 		errs = append(errs, trc.cb())
 	}
 	for _, err := range errs {
@@ -39,6 +51,40 @@ func (trc *teeReadCloser) Close() error {
 	return nil
 }
 
+type closeNotifyReadCloser struct {
+	io.ReadCloser
+	fn func()
+}
+
+// wrap a reader to run fn after it is closed
+func newCloseNotifyRC(r io.ReadCloser, fn func()) io.ReadCloser {
+	return &closeNotifyReadCloser{
+		ReadCloser: r,
+		fn:         fn,
+	}
+}
+
+// Close passes through the close request and then runs the notify func
+func (cnrc *closeNotifyReadCloser) Close() error {
+	err := cnrc.ReadCloser.Close()
+	cnrc.fn()
+	return err
+}
+
+// errWriter tracks errors from the underlying writer
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	n, err := ew.w.Write(p)
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+	return n, err
+}
+
 type newRC func() (io.ReadCloser, error)
 type hashReadCloser struct {
 	io.ReadCloser
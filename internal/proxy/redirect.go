@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// maxRedirects limits the number of redirects followed by the proxy
+const maxRedirects = 10
+
+// newClientFollow returns a client that follows redirects for the proxy
+func newClientFollow(rt http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: rt,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return policyRedirect(req)
+		},
+	}
+}
+
+// upstreamClient returns the client used for a request
+func (p *proxy) upstreamClient(req *http.Request) *http.Client {
+	if p.clientFollow != nil && p.followRedirects(req) {
+		return p.clientFollow
+	}
+	return p.client
+}
+
+// followRedirects returns true if redirects should be followed by the proxy for the request host
+func (p *proxy) followRedirects(req *http.Request) bool {
+	for _, pattern := range p.conf.Proxy.FollowRedirects {
+		if hostMatch(pattern, req.URL.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostMatch compares a hostname to a glob pattern
+func hostMatch(pattern, host string) bool {
+	match, err := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return err == nil && match
+}
+
+// redirectChain returns each redirect followed to reach the response, in order
+func redirectChain(resp *http.Response) []storageMetaRedirect {
+	chain := []storageMetaRedirect{}
+	for req := resp.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		// the query is excluded since signed redirect targets change on every request
+		u := *req.URL
+		u.RawQuery = ""
+		chain = append([]storageMetaRedirect{{
+			StatusCode: req.Response.StatusCode,
+			Location:   u.String(),
+		}}, chain...)
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRedirectChain(t *testing.T) {
+	u1, _ := url.Parse("https://example.com/download")
+	u2, _ := url.Parse("https://cdn.example.com/file?sig=abc")
+	u3, _ := url.Parse("https://storage.example.org/file?sig=def&expires=123")
+	req1 := &http.Request{URL: u1}
+	resp1 := &http.Response{StatusCode: http.StatusFound, Request: req1}
+	req2 := &http.Request{URL: u2, Response: resp1}
+	resp2 := &http.Response{StatusCode: http.StatusTemporaryRedirect, Request: req2}
+	req3 := &http.Request{URL: u3, Response: resp2}
+	resp3 := &http.Response{StatusCode: http.StatusOK, Request: req3}
+
+	chain := redirectChain(resp3)
+	expect := []storageMetaRedirect{
+		{StatusCode: http.StatusFound, Location: "https://cdn.example.com/file"},
+		{StatusCode: http.StatusTemporaryRedirect, Location: "https://storage.example.org/file"},
+	}
+	if len(chain) != len(expect) {
+		t.Errorf("chain length mismatch, expected %d, received %v", len(expect), chain)
+		return
+	}
+	for i := range expect {
+		if chain[i] != expect[i] {
+			t.Errorf("chain entry %d mismatch, expected %v, received %v", i, expect[i], chain[i])
+		}
+	}
+
+	if redirectChain(resp1) != nil {
+		t.Errorf("unexpected chain for a response without redirects")
+	}
+}
+
+func TestHostMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		expect  bool
+	}{
+		{pattern: "example.com", host: "example.com", expect: true},
+		{pattern: "example.com", host: "EXAMPLE.com", expect: true},
+		{pattern: "*.example.com", host: "cdn.example.com", expect: true},
+		{pattern: "*.example.com", host: "example.com", expect: false},
+		{pattern: "*", host: "example.org", expect: true},
+		{pattern: "example.com", host: "example.org", expect: false},
+	}
+	for _, tt := range tests {
+		if result := hostMatch(tt.pattern, tt.host); result != tt.expect {
+			t.Errorf("hostMatch(%s, %s): expected %t, received %t", tt.pattern, tt.host, tt.expect, result)
+		}
+	}
+}
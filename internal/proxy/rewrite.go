@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteReq applies the first matching rewrite rule,
+// reqStore is changed to the canonical url and reqDo to the upstream url
+func (p *proxy) rewriteReq(reqStore, reqDo *http.Request) {
+	for _, rw := range p.conf.Proxy.Rewrites {
+		if !urlPrefixMatch(rw.From, reqStore.URL) {
+			continue
+		}
+		if rw.To != nil {
+			reqStore.URL = rewriteURL(reqStore.URL, rw.From, rw.To)
+			reqStore.Host = ""
+		}
+		if rw.Upstream != nil {
+			reqDo.URL = rewriteURL(reqDo.URL, rw.From, rw.Upstream)
+			reqDo.Host = ""
+		}
+		return
+	}
+}
+
+// urlPrefixMatch returns true when u has the same scheme and host, and the path begins with the prefix path
+func urlPrefixMatch(prefix, u *url.URL) bool {
+	return prefix != nil &&
+		strings.EqualFold(prefix.Scheme, u.Scheme) &&
+		strings.EqualFold(prefix.Host, u.Host) &&
+		strings.HasPrefix(u.Path, prefix.Path)
+}
+
+// rewriteURL replaces the from prefix of u with the to prefix, the query is preserved
+func rewriteURL(u, from, to *url.URL) *url.URL {
+	uNew := *u
+	uNew.Scheme = to.Scheme
+	uNew.Host = to.Host
+	uNew.Path = to.Path + strings.TrimPrefix(u.Path, from.Path)
+	uNew.RawPath = ""
+	return &uNew
+}
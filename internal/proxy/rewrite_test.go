@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/httplock/httplock/internal/storage"
+)
+
+func TestRewriteReq(t *testing.T) {
+	conf := `{"proxy": {"rewrites": [
+		{"from": "https://mirror.example.org/maven2/", "to": "https://repo.example.com/maven2/"},
+		{"from": "https://repo.example.com/maven2/", "upstream": "https://mirror.example.org/maven2/"},
+		{"from": "http://pypi.local/simple/", "to": "https://pypi.example.com/simple/", "upstream": "http://pypi.local:8080/pypi/simple/"}
+	]}}`
+	c := config.Config{}
+	err := config.LoadReader(strings.NewReader(conf), &c)
+	if err != nil {
+		t.Errorf("failed to load config: %v", err)
+		return
+	}
+	p := proxy{conf: c}
+
+	tests := []struct {
+		name           string
+		url            string
+		expectStore    string
+		expectUpstream string
+	}{
+		{
+			name:           "no match",
+			url:            "https://other.example.com/maven2/a.jar",
+			expectStore:    "https://other.example.com/maven2/a.jar",
+			expectUpstream: "https://other.example.com/maven2/a.jar",
+		},
+		{
+			name:           "mirror to canonical",
+			url:            "https://mirror.example.org/maven2/org/a.jar?x=1",
+			expectStore:    "https://repo.example.com/maven2/org/a.jar?x=1",
+			expectUpstream: "https://mirror.example.org/maven2/org/a.jar?x=1",
+		},
+		{
+			name:           "upstream only",
+			url:            "https://repo.example.com/maven2/org/a.jar",
+			expectStore:    "https://repo.example.com/maven2/org/a.jar",
+			expectUpstream: "https://mirror.example.org/maven2/org/a.jar",
+		},
+		{
+			name:           "canonical and upstream",
+			url:            "http://pypi.local/simple/pkg/",
+			expectStore:    "https://pypi.example.com/simple/pkg/",
+			expectUpstream: "http://pypi.local:8080/pypi/simple/pkg/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+				return
+			}
+			reqStore, reqDo, err := p.filterReq(req)
+			if err != nil {
+				t.Errorf("failed to filter request: %v", err)
+				return
+			}
+			p.rewriteReq(reqStore, reqDo)
+			if reqStore.URL.String() != tt.expectStore {
+				t.Errorf("unexpected store url, expected %s, received %s", tt.expectStore, reqStore.URL.String())
+			}
+			if reqDo.URL.String() != tt.expectUpstream {
+				t.Errorf("unexpected upstream url, expected %s, received %s", tt.expectUpstream, reqDo.URL.String())
+			}
+			if req.URL.String() != tt.url {
+				t.Errorf("original request modified to %s", req.URL.String())
+			}
+		})
+	}
+}
+
+func TestRewritePolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mirror content"))
+	}))
+	defer ts.Close()
+	// the canonical host is denied and only reachable through the mirror
+	conf := fmt.Sprintf(`{"proxy": {
+		"policy": {"deny": [{"host": "repo.example.com"}, {"host": "blocked.example.org"}]},
+		"rewrites": [
+			{"from": "http://repo.example.com/", "upstream": "%s/"},
+			{"from": "http://open.example.com/", "upstream": "http://blocked.example.org/"}
+		]
+	}}`, ts.URL)
+	c, err := config.New(config.ConfigOpts{})
+	if err != nil {
+		t.Errorf("failed to create config: %v", err)
+		return
+	}
+	err = config.LoadReader(strings.NewReader(conf), &c)
+	if err != nil {
+		t.Errorf("failed to load config: %v", err)
+		return
+	}
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	p := proxy{conf: c, storage: s}
+
+	tests := []struct {
+		name       string
+		url        string
+		expectCode int
+		expectBody string
+	}{
+		{
+			name:       "denied host with allowed upstream",
+			url:        "http://repo.example.com/a.jar",
+			expectCode: http.StatusOK,
+			expectBody: "mirror content",
+		},
+		{
+			name:       "allowed host with denied upstream",
+			url:        "http://open.example.com/a.jar",
+			expectCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root, err := s.RootCreate()
+			if err != nil {
+				t.Errorf("failed to create root: %v", err)
+				return
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			p.serveWithCache(w, req, root)
+			if w.Code != tt.expectCode {
+				t.Errorf("status mismatch, expected %d, received %d", tt.expectCode, w.Code)
+			}
+			if tt.expectBody != "" {
+				b, _ := io.ReadAll(w.Body)
+				if string(b) != tt.expectBody {
+					t.Errorf("body mismatch, expected %s, received %s", tt.expectBody, b)
+				}
+			}
+		})
+	}
+}
+
+func TestRewriteConfig(t *testing.T) {
+	c := config.Config{}
+	err := config.LoadReader(strings.NewReader(`{"proxy": {"rewrites": [{"to": "https://example.com/"}]}}`), &c)
+	if err == nil {
+		t.Errorf("rewrite without a from url was accepted")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/httplock/httplock/hasher"
 	"github.com/httplock/httplock/internal/storage"
@@ -15,6 +17,7 @@ const (
 	extReqBody  = "-req-body"
 	extRespHead = "-resp-head"
 	extRespBody = "-resp-body"
+	extPolicy   = "-policy"
 )
 
 // TODO: add headers that should not be used in cache calculations
@@ -30,13 +33,57 @@ type storageMetaReq struct {
 	Headers    http.Header
 	ContentLen int64
 	BodyHash   string
+	ClientCert *storageMetaClientCert `json:",omitempty"`
 }
 
+// storageMetaClientCert identifies the client certificate sent upstream
+type storageMetaClientCert struct {
+	Subject     string
+	Fingerprint string
+}
+
+// storageMetaRespVersion is the current version of the response metadata format
+// entries recorded before versioning was added are treated as version 1
+const storageMetaRespVersion = 2
+
 type storageMetaResp struct {
+	Version         int `json:",omitempty"`
+	StatusCode      int
+	Headers         http.Header
+	ContentLen      int64
+	BodyHash        string
+	ContentEncoding string                `json:",omitempty"` // original encoding of a body stored decoded
+	Trailers        http.Header           `json:",omitempty"`
+	Informational   []storageMetaInfo     `json:",omitempty"`
+	Redirects       []storageMetaRedirect `json:",omitempty"`
+	TLSChain        []string              `json:"-"` // stored as root metadata, certificates rotate without the content changing
+	Timing          *storageMetaTiming    `json:"-"` // stored as root metadata to keep the hash stable
+}
+
+// storageMetaRecord is saved as root metadata on the request hash path,
+// it describes a single recording and is excluded from the root hash
+type storageMetaRecord struct {
+	storageMetaTiming
+	TLSChain []string `json:",omitempty"` // fingerprints of the upstream certificates
+}
+
+// storageMetaInfo is an informational (1xx) response received before the final response
+type storageMetaInfo struct {
 	StatusCode int
 	Headers    http.Header
-	ContentLen int64
-	BodyHash   string
+}
+
+// storageMetaRedirect is a redirect followed by the proxy before the final response
+type storageMetaRedirect struct {
+	StatusCode int
+	Location   string
+}
+
+// storageMetaPolicy is a request rejected by the policy
+type storageMetaPolicy struct {
+	Method string
+	URL    string
+	Reason string
 }
 
 func includeHeader(header string) bool {
@@ -76,8 +123,9 @@ func storageGenReqHash(req *http.Request, s storage.Storage, root *storage.Root)
 	if hrc, ok := req.Body.(*hashReadCloser); ok && hrc != nil {
 		hashItems.BodyHash = hrc.h
 	} else {
-		// read body into storage
-		bw, err := s.BlobCreate()
+		// read body into storage, the body hash is part of the request key
+		// and always uses the default algorithm so existing roots continue to match
+		bw, err := s.BlobCreate(storage.WithAlgorithm(hasher.Default))
 		if err != nil {
 			return "", "", err
 		}
@@ -131,32 +179,62 @@ func storageGenReqHash(req *http.Request, s storage.Storage, root *storage.Root)
 	return h, hashItems.BodyHash, nil
 }
 
-// storageGetResp returns the response if it's cached
-func storageGetResp(req *http.Request, s storage.Storage, root *storage.Root) (*http.Response, error) {
+// storageGenKey returns a key that identifies the request within a root
+func storageGenKey(req *http.Request, s storage.Storage, root *storage.Root) (string, error) {
+	reqHash, _, err := storageGenReqHash(req, s, root)
+	if err != nil {
+		return "", err
+	}
+	dirElems, err := storageGenDirPath(req)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append(dirElems, reqHash), "\n"), nil
+}
+
+// storageGetResp returns the response and its metadata if it's cached
+func storageGetResp(req *http.Request, s storage.Storage, root *storage.Root) (*http.Response, *storageMetaResp, error) {
 	// hash must always be generated on the GetResp to replace the req body with a hashing version
 	reqHash, _, err := storageGenReqHash(req, s, root)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	dirElems, err := storageGenDirPath(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	respHeadBR, err := root.Read(append(dirElems, reqHash+extRespHead))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer respHeadBR.Close()
 	respBodyBR, err := root.Read(append(dirElems, reqHash+extRespBody))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	// the head is read to EOF so a verifying reader can check the content
+	respHead, err := io.ReadAll(respHeadBR)
+	if err != nil {
+		respBodyBR.Close()
+		return nil, nil, err
+	}
 	metaResp := storageMetaResp{}
-	err = json.NewDecoder(respHeadBR).Decode(&metaResp)
+	err = json.Unmarshal(respHead, &metaResp)
 	if err != nil {
 		respBodyBR.Close()
-		return nil, err
+		return nil, nil, err
+	}
+	if metaResp.Version > storageMetaRespVersion {
+		respBodyBR.Close()
+		return nil, nil, fmt.Errorf("unsupported response metadata version %d", metaResp.Version)
+	}
+	record := storageMetaRecord{}
+	if err := root.GetMeta(append(dirElems, reqHash), &record); err == nil {
+		if record.Duration > 0 {
+			metaResp.Timing = &record.storageMetaTiming
+		}
+		metaResp.TLSChain = record.TLSChain
 	}
 	resp := http.Response{
 		Header: http.Header{},
@@ -172,15 +250,19 @@ func storageGetResp(req *http.Request, s storage.Storage, root *storage.Root) (*
 		resp.StatusCode = metaResp.StatusCode
 		resp.Status = http.StatusText(metaResp.StatusCode)
 	}
+	if len(metaResp.Trailers) > 0 {
+		resp.Trailer = metaResp.Trailers.Clone()
+	}
 	resp.ContentLength = metaResp.ContentLen
 	resp.Body = respBodyBR
 
-	return &resp, nil
+	return &resp, &metaResp, nil
 }
 
 // write a CF based on the response
 // request and response body will be read, these should be replaced with tee readers to process the data elsewhere
-func storagePutResp(req *http.Request, resp *http.Response, s storage.Storage, root *storage.Root) error {
+// rt may be nil when no trace was collected from the upstream request
+func storagePutResp(req *http.Request, resp *http.Response, rt *respTrace, s storage.Storage, root *storage.Root) error {
 	dirElems, err := storageGenDirPath(req)
 	if err != nil {
 		return fmt.Errorf("generating path: %w", err)
@@ -198,50 +280,121 @@ func storagePutResp(req *http.Request, resp *http.Response, s storage.Storage, r
 		Headers:    req.Header,
 		BodyHash:   reqBodyHash,
 		ContentLen: req.ContentLength,
+		ClientCert: rt.clientCert(),
 	}
 	metaResp := storageMetaResp{
-		Headers:    resp.Header,
-		StatusCode: resp.StatusCode,
-		ContentLen: resp.ContentLength,
-	}
-
-	reqHeadBW, err := root.Write(append(dirElems, reqHash+extReqHead))
-	if err != nil {
-		return fmt.Errorf("root write for req head: %w", err)
-	}
-	err = json.NewEncoder(reqHeadBW).Encode(metaReq)
-	reqHeadBW.Close()
-	if err != nil {
-		return fmt.Errorf("json encode req: %w", err)
-	}
-
-	err = root.Link(append(dirElems, reqHash+extReqBody), reqBodyHash)
-	if err != nil {
-		return fmt.Errorf("root link for req body: %w", err)
+		Version:         storageMetaRespVersion,
+		Headers:         resp.Header,
+		StatusCode:      resp.StatusCode,
+		ContentLen:      resp.ContentLength,
+		Informational:   rt.informational(),
+		ContentEncoding: rt.contentEncoding(),
+		Redirects:       redirectChain(resp),
+		TLSChain:        tlsChain(resp.TLS),
 	}
 
 	// replace resp.Body with a tee reader to cache body contents
-	respBodyBW, err := root.Write(append(dirElems, reqHash+extRespBody))
+	// entries are only added to the root once the full body has been read
+	respBodyBW, err := root.BlobCreate()
 	if err != nil {
-		return fmt.Errorf("root write for resp body: %w", err)
+		return fmt.Errorf("blob create for resp body: %w", err)
 	}
-	resp.Body = newTeeRC(resp.Body, respBodyBW, func() error {
-		// save the resp-head after the body has been cached to include the hash
-		respHeadBW, err := root.Write(append(dirElems, reqHash+extRespHead))
+	respBodyCW := &countWriter{WriteCloser: respBodyBW}
+	resp.Body = newTeeRC(rt.body(resp.Body), respBodyCW, func() error {
+		reqHeadHash, err := storageJSONBlob(root, metaReq)
 		if err != nil {
-			return fmt.Errorf("root write for resp head: %w", err)
+			return fmt.Errorf("blob for req head: %w", err)
 		}
 		metaResp.BodyHash, err = respBodyBW.Hash()
 		if err != nil {
 			return fmt.Errorf("extracting response body hash: %w", err)
 		}
-		err = json.NewEncoder(respHeadBW).Encode(metaResp)
-		respHeadBW.Close()
+		// trailers are only available after the body has been read
+		for k, vv := range resp.Trailer {
+			if len(vv) == 0 {
+				continue
+			}
+			if metaResp.Trailers == nil {
+				metaResp.Trailers = http.Header{}
+			}
+			metaResp.Trailers[k] = vv
+		}
+		// the resp-head is created after the body has been cached to include the hash
+		respHeadHash, err := storageJSONBlob(root, metaResp)
+		if err != nil {
+			return fmt.Errorf("blob for resp head: %w", err)
+		}
+		// an existing recording is kept so the first completed response is the winner
+		added, err := root.LinkAbsent(dirElems, map[string]string{
+			reqHash + extReqHead:  reqHeadHash,
+			reqHash + extReqBody:  reqBodyHash,
+			reqHash + extRespHead: respHeadHash,
+			reqHash + extRespBody: metaResp.BodyHash,
+		})
 		if err != nil {
-			return fmt.Errorf("json encode response head: %w", err)
+			return fmt.Errorf("root link for response: %w", err)
+		}
+		if !added {
+			return nil
+		}
+		record := storageMetaRecord{TLSChain: metaResp.TLSChain}
+		if timing := rt.timing(respBodyCW.n); timing != nil {
+			record.storageMetaTiming = *timing
+		}
+		if record.Duration > 0 || len(record.TLSChain) > 0 {
+			err = root.SetMeta(append(dirElems, reqHash), record)
+			if err != nil {
+				return fmt.Errorf("root set meta for recording: %w", err)
+			}
 		}
 		return nil
 	})
 
 	return nil
 }
+
+// storageJSONBlob encodes v into a new blob that is not yet linked into the root
+func storageJSONBlob(root *storage.Root, v interface{}) (string, error) {
+	bw, err := root.BlobCreate()
+	if err != nil {
+		return "", err
+	}
+	err = json.NewEncoder(bw).Encode(v)
+	errClose := bw.Close()
+	if err != nil {
+		return "", fmt.Errorf("json encode: %w", err)
+	}
+	if errClose != nil {
+		return "", errClose
+	}
+	return bw.Hash()
+}
+
+// storagePutPolicy records a policy violation in the root, repeated violations are stored once
+func storagePutPolicy(method string, u *url.URL, reason string, root *storage.Root) error {
+	uDir := *u
+	uDir.RawQuery = ""
+	metaPolicy := storageMetaPolicy{
+		Method: method,
+		URL:    u.String(),
+		Reason: reason,
+	}
+	j, err := json.Marshal(metaPolicy)
+	if err != nil {
+		return fmt.Errorf("json marshal: %w", err)
+	}
+	h, err := hasher.FromBytes(j)
+	if err != nil {
+		return fmt.Errorf("hash from bytes: %w", err)
+	}
+	bw, err := root.Write([]string{u.Host, uDir.String(), h + extPolicy})
+	if err != nil {
+		return fmt.Errorf("root write for policy: %w", err)
+	}
+	_, err = bw.Write(j)
+	errClose := bw.Close()
+	if err != nil {
+		return err
+	}
+	return errClose
+}
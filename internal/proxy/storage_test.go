@@ -2,10 +2,14 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/httplock/httplock/internal/config"
 	"github.com/httplock/httplock/internal/storage"
@@ -42,6 +46,8 @@ func TestStorage(t *testing.T) {
 	respBodyRdr := bytes.NewReader(respBodyText)
 	resp.Body = io.NopCloser(respBodyRdr)
 	resp.ContentLength = int64(len(respBodyText))
+	resp.Trailer = http.Header{}
+	resp.Trailer.Add("X-Checksum", "12345")
 
 	c := config.Config{}
 	c.Storage.Kind = "memory"
@@ -57,7 +63,7 @@ func TestStorage(t *testing.T) {
 	}
 
 	t.Run("GetMissing", func(t *testing.T) {
-		getResp, err := storageGetResp(&req, sMem, root)
+		getResp, _, err := storageGetResp(&req, sMem, root)
 		if err == nil {
 			t.Errorf("Get a missing value unexpected succeeded: %v", getResp)
 			return
@@ -71,7 +77,7 @@ func TestStorage(t *testing.T) {
 		if err != nil {
 			t.Errorf("Failed to close req body: %v", err)
 		}
-		err = storagePutResp(&req, &resp, sMem, root)
+		err = storagePutResp(&req, &resp, nil, sMem, root)
 		if err != nil {
 			t.Errorf("Failed to put response in cache: %v", err)
 		}
@@ -87,7 +93,7 @@ func TestStorage(t *testing.T) {
 	})
 
 	t.Run("GetResponse", func(t *testing.T) {
-		getResp, err := storageGetResp(&req, sMem, root)
+		getResp, _, err := storageGetResp(&req, sMem, root)
 		if err != nil {
 			t.Errorf("Failed to retrieve response: %v", err)
 			return
@@ -95,5 +101,183 @@ func TestStorage(t *testing.T) {
 		if getResp.StatusCode != resp.StatusCode {
 			t.Errorf("Response mismatch on StatusCode: got %d, expect %d", getResp.StatusCode, resp.StatusCode)
 		}
+		if getResp.Trailer.Get("X-Checksum") != resp.Trailer.Get("X-Checksum") {
+			t.Errorf("Response mismatch on Trailer: got %v, expect %v", getResp.Trailer, resp.Trailer)
+		}
+		getResp.Body.Close()
+	})
+
+	t.Run("PutDuplicate", func(t *testing.T) {
+		// a later response for the same request does not replace the first recording
+		respDup := http.Response{
+			StatusCode: 500,
+			Header:     http.Header{},
+			Body:       io.NopCloser(bytes.NewReader([]byte("error"))),
+		}
+		err = storagePutResp(&req, &respDup, nil, sMem, root)
+		if err != nil {
+			t.Errorf("Failed to put response in cache: %v", err)
+		}
+		_, err = io.ReadAll(respDup.Body)
+		if err != nil {
+			t.Errorf("Failed to read resp: %v", err)
+		}
+		err = respDup.Body.Close()
+		if err != nil {
+			t.Errorf("Failed to close resp body: %v", err)
+		}
+		getResp, _, err := storageGetResp(&req, sMem, root)
+		if err != nil {
+			t.Errorf("Failed to retrieve response: %v", err)
+			return
+		}
+		defer getResp.Body.Close()
+		if getResp.StatusCode != resp.StatusCode {
+			t.Errorf("Response replaced: got status %d, expect %d", getResp.StatusCode, resp.StatusCode)
+		}
+		body, err := io.ReadAll(getResp.Body)
+		if err != nil {
+			t.Errorf("Failed to read resp: %v", err)
+			return
+		}
+		if !bytes.Equal(body, respBodyText) {
+			t.Errorf("Response replaced: got body %s, expect %s", body, respBodyText)
+		}
 	})
 }
+
+func TestStorageTLSChain(t *testing.T) {
+	reqURL, _ := url.Parse("https://example.com/cert")
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	hashes := []string{}
+	for _, certs := range [][]byte{[]byte("cert one"), []byte("cert two")} {
+		req := http.Request{
+			Method: "GET",
+			Proto:  "HTTP/1.1",
+			URL:    reqURL,
+			Header: http.Header{},
+			Body:   http.NoBody,
+		}
+		resp := http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(bytes.NewReader([]byte("same content"))),
+			TLS:        &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: certs}}},
+		}
+		_, root, err := s.RootCreate()
+		if err != nil {
+			t.Errorf("failed setting up root: %v", err)
+			return
+		}
+		err = storagePutResp(&req, &resp, &respTrace{start: time.Now()}, s, root)
+		if err != nil {
+			t.Errorf("failed to put response: %v", err)
+			return
+		}
+		_, err = io.ReadAll(resp.Body)
+		if err != nil {
+			t.Errorf("failed to read body: %v", err)
+		}
+		resp.Body.Close()
+		getResp, metaResp, err := storageGetResp(&req, s, root)
+		if err != nil {
+			t.Errorf("failed to get response: %v", err)
+			return
+		}
+		getResp.Body.Close()
+		expect := tlsChain(resp.TLS)
+		if len(metaResp.TLSChain) != 1 || metaResp.TLSChain[0] != expect[0] {
+			t.Errorf("unexpected chain, expected %v, received %v", expect, metaResp.TLSChain)
+		}
+		hash, err := root.Save()
+		if err != nil {
+			t.Errorf("failed to save root: %v", err)
+			return
+		}
+		hashes = append(hashes, hash)
+	}
+	// a rotated upstream certificate does not change the recording
+	if hashes[0] != hashes[1] {
+		t.Errorf("root hash depends on the certificate chain, %s != %s", hashes[0], hashes[1])
+	}
+}
+
+func TestStorageAlgorithm(t *testing.T) {
+	reqURL, _ := url.Parse("http://example.com/algo")
+	// create a sha512 root and import it into storage with the default algorithm
+	c := config.Config{}
+	c.Storage.Kind = "memory"
+	c.Storage.Hash = "sha512"
+	sSrc, err := storage.Get(c)
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, rootSrc, err := sSrc.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	hash, err := sSrc.RootSave(rootSrc)
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+	buf := bytes.Buffer{}
+	err = storage.Export(sSrc, hash, &buf)
+	if err != nil {
+		t.Errorf("failed to export root: %v", err)
+		return
+	}
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	err = storage.Import(s, hash, &buf)
+	if err != nil {
+		t.Errorf("failed to import root: %v", err)
+		return
+	}
+	_, root, err := s.RootCreateFrom(hash)
+	if err != nil {
+		t.Errorf("failed to create root from %s: %v", hash, err)
+		return
+	}
+
+	req := http.Request{
+		Method: "GET",
+		Proto:  "HTTP/1.1",
+		URL:    reqURL,
+		Header: http.Header{},
+		Body:   http.NoBody,
+	}
+	resp := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader([]byte("hello sha512"))),
+	}
+	err = storagePutResp(&req, &resp, &respTrace{start: time.Now()}, s, root)
+	if err != nil {
+		t.Errorf("failed to put response: %v", err)
+		return
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("failed to read body: %v", err)
+	}
+	resp.Body.Close()
+	getResp, metaResp, err := storageGetResp(&req, s, root)
+	if err != nil {
+		t.Errorf("failed to get response: %v", err)
+		return
+	}
+	getResp.Body.Close()
+	if !strings.HasPrefix(metaResp.BodyHash, "sha512:") {
+		t.Errorf("body hash does not use the root algorithm: %s", metaResp.BodyHash)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// storageMetaTiming is recorded for each response outside of the root hash
+type storageMetaTiming struct {
+	TTFB     time.Duration // time from sending the request until the first response byte
+	Duration time.Duration // time from sending the request until the full body was received
+	Size     int64         // bytes of the body received
+}
+
+// rate returns the bytes per second of the body transfer, or 0 when unknown
+func (t *storageMetaTiming) rate() float64 {
+	if t == nil || t.Size <= 0 {
+		return 0
+	}
+	transfer := t.Duration - t.TTFB
+	if transfer <= 0 {
+		return 0
+	}
+	return float64(t.Size) / transfer.Seconds()
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	io.WriteCloser
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.WriteCloser.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// throttleReader limits reads to a rate in bytes per second
+type throttleReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  float64
+	chunk int
+	start time.Time
+	n     int64
+}
+
+func newThrottleReader(ctx context.Context, r io.Reader, rate float64) *throttleReader {
+	// small reads avoid long pauses at low rates
+	chunk := int(rate / 10)
+	if chunk < 512 {
+		chunk = 512
+	}
+	return &throttleReader{
+		ctx:   ctx,
+		r:     r,
+		rate:  rate,
+		chunk: chunk,
+		start: time.Now(),
+	}
+}
+
+func (tr *throttleReader) Read(p []byte) (int, error) {
+	if len(p) > tr.chunk {
+		p = p[:tr.chunk]
+	}
+	n, err := tr.r.Read(p)
+	tr.n += int64(n)
+	expect := time.Duration(float64(tr.n) / tr.rate * float64(time.Second))
+	if wait := expect - time.Since(tr.start); wait > 0 {
+		if errSleep := sleepCtx(tr.ctx, wait); errSleep != nil {
+			return n, errSleep
+		}
+	}
+	return n, err
+}
+
+// sleepCtx waits for the duration, returning early with an error when the context is done
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
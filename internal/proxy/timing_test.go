@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/httplock/httplock/internal/storage"
+)
+
+func TestTimingRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		timing *storageMetaTiming
+		expect float64
+	}{
+		{
+			name:   "nil",
+			expect: 0,
+		},
+		{
+			name:   "empty body",
+			timing: &storageMetaTiming{TTFB: time.Second, Duration: 2 * time.Second},
+			expect: 0,
+		},
+		{
+			name:   "no transfer time",
+			timing: &storageMetaTiming{TTFB: time.Second, Duration: time.Second, Size: 100},
+			expect: 0,
+		},
+		{
+			name:   "rate",
+			timing: &storageMetaTiming{TTFB: time.Second, Duration: 3 * time.Second, Size: 1000},
+			expect: 500,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.timing.rate()
+			if result != tt.expect {
+				t.Errorf("unexpected rate, expected %f, received %f", tt.expect, result)
+			}
+		})
+	}
+}
+
+func TestThrottleReader(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 20000)
+	start := time.Now()
+	tr := newThrottleReader(context.Background(), bytes.NewReader(body), 100000)
+	b, err := io.ReadAll(tr)
+	if err != nil {
+		t.Errorf("failed to read: %v", err)
+		return
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("body mismatch")
+	}
+	// 20k bytes at 100k bytes per second
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("read was not throttled, finished in %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr = newThrottleReader(ctx, bytes.NewReader(body), 1000)
+	_, err = io.ReadAll(tr)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("unexpected error from canceled read: %v", err)
+	}
+}
+
+func TestTimingEOF(t *testing.T) {
+	reqURL, _ := url.Parse("http://example.com/slow-client")
+	req := http.Request{
+		Method: "GET",
+		Proto:  "HTTP/1.1",
+		URL:    reqURL,
+		Header: http.Header{},
+		Body:   http.NoBody,
+	}
+	resp := http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader([]byte("timed body"))),
+	}
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, root, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	rt := &respTrace{start: time.Now()}
+	err = storagePutResp(&req, &resp, rt, s, root)
+	if err != nil {
+		t.Errorf("failed to put response: %v", err)
+		return
+	}
+	_, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Errorf("failed to read body: %v", err)
+		return
+	}
+	// a slow client closing the body must not extend the recorded duration
+	delay := 200 * time.Millisecond
+	time.Sleep(delay)
+	resp.Body.Close()
+	_, metaResp, err := storageGetResp(&req, s, root)
+	if err != nil {
+		t.Errorf("failed to get response: %v", err)
+		return
+	}
+	if metaResp.Timing == nil {
+		t.Errorf("timing was not recorded")
+		return
+	}
+	if metaResp.Timing.Duration >= delay {
+		t.Errorf("duration %v includes the time until close", metaResp.Timing.Duration)
+	}
+}
+
+func TestReplayLatency(t *testing.T) {
+	delay := 300 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte("0123456789"))
+	}))
+	defer ts.Close()
+	c, err := config.New(config.ConfigOpts{})
+	if err != nil {
+		t.Errorf("failed to create config: %v", err)
+		return
+	}
+	c.Proxy.RangeFull = true
+	c.Proxy.ReplayLatency = true
+	s, err := storage.NewMemory()
+	if err != nil {
+		t.Errorf("failed setting up storage: %v", err)
+		return
+	}
+	_, root, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed setting up root: %v", err)
+		return
+	}
+	p := proxy{conf: c, storage: s}
+	tests := []struct {
+		name     string
+		minDelay time.Duration
+	}{
+		{
+			// the range is served from the cache after the full download without adding the recorded latency
+			name: "miss",
+		},
+		{
+			name:     "replay",
+			minDelay: delay,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+			req.Header.Set("Range", "bytes=2-4")
+			w := httptest.NewRecorder()
+			start := time.Now()
+			p.serveWithCache(w, req, root)
+			elapsed := time.Since(start)
+			if w.Code != http.StatusPartialContent || w.Body.String() != "234" {
+				t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+			}
+			if elapsed < tt.minDelay {
+				t.Errorf("response took %v, expected at least %v", elapsed, tt.minDelay)
+			}
+			if elapsed > tt.minDelay+delay*3/2 {
+				t.Errorf("response took %v, recorded latency was replayed on a download", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// respTrace collects details from an upstream request that are not included in the http.Response
+type respTrace struct {
+	mu        sync.Mutex
+	info      []storageMetaInfo
+	encoding  string // original content encoding when the body is decoded
+	identity  *storageMetaClientCert
+	start     time.Time // when the request was sent upstream
+	firstByte time.Time
+	lastByte  time.Time // when the end of the body was received
+}
+
+// clientTrace returns hooks for the upstream request, 1xx responses are forwarded to w when provided
+func (rt *respTrace) clientTrace(w http.ResponseWriter) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			// redirects followed by the proxy update this to the final response
+			rt.mu.Lock()
+			rt.firstByte = time.Now()
+			rt.mu.Unlock()
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			// 100 and 101 are specific to each hop and are not recorded
+			if code == http.StatusContinue || code == http.StatusSwitchingProtocols {
+				return nil
+			}
+			h := http.Header(header).Clone()
+			rt.mu.Lock()
+			rt.info = append(rt.info, storageMetaInfo{
+				StatusCode: code,
+				Headers:    h,
+			})
+			rt.mu.Unlock()
+			if w != nil {
+				writeInformational(w, code, h)
+			}
+			return nil
+		},
+	}
+}
+
+// informational returns the 1xx responses received before the final response
+func (rt *respTrace) informational() []storageMetaInfo {
+	if rt == nil {
+		return nil
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.info
+}
+
+// writeInformational sends a 1xx response to the client without leaving the headers on the final response
+func writeInformational(w http.ResponseWriter, code int, header http.Header) {
+	wh := w.Header()
+	for k, vv := range header {
+		wh[k] = vv
+	}
+	w.WriteHeader(code)
+	for k := range header {
+		delete(wh, k)
+	}
+}
+
+// announceTrailers declares the trailer keys, this must be called before the header is written
+func announceTrailers(w http.ResponseWriter, trailer http.Header) {
+	wh := w.Header()
+	for k := range trailer {
+		wh.Add("Trailer", k)
+	}
+}
+
+// writeTrailers adds trailers to the client response, this must be called after the body is sent
+func writeTrailers(w http.ResponseWriter, trailer http.Header) {
+	wh := w.Header()
+	for k, vv := range trailer {
+		for _, v := range vv {
+			wh.Add(http.TrailerPrefix+k, v)
+		}
+	}
+}
+
+// contentEncoding returns the original content encoding of a decoded body
+func (rt *respTrace) contentEncoding() string {
+	if rt == nil {
+		return ""
+	}
+	return rt.encoding
+}
+
+// timing returns the timing of an upstream request that finished receiving size bytes
+func (rt *respTrace) timing(size int64) *storageMetaTiming {
+	if rt == nil || rt.start.IsZero() {
+		return nil
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	end := rt.lastByte
+	if end.IsZero() {
+		end = time.Now()
+	}
+	t := storageMetaTiming{
+		Duration: end.Sub(rt.start),
+		Size:     size,
+	}
+	if !rt.firstByte.IsZero() {
+		t.TTFB = rt.firstByte.Sub(rt.start)
+	}
+	return &t
+}
+
+// body wraps an upstream body to record when the end is received, independent of when the client closes it
+func (rt *respTrace) body(rc io.ReadCloser) io.ReadCloser {
+	if rt == nil {
+		return rc
+	}
+	return &traceReadCloser{ReadCloser: rc, rt: rt}
+}
+
+type traceReadCloser struct {
+	io.ReadCloser
+	rt *respTrace
+}
+
+func (trc *traceReadCloser) Read(p []byte) (int, error) {
+	n, err := trc.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		trc.rt.mu.Lock()
+		if trc.rt.lastByte.IsZero() {
+			trc.rt.lastByte = time.Now()
+		}
+		trc.rt.mu.Unlock()
+	}
+	return n, err
+}
+
+// clientCert returns the identity of the client certificate sent upstream
+func (rt *respTrace) clientCert() *storageMetaClientCert {
+	if rt == nil {
+		return nil
+	}
+	return rt.identity
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
+)
+
+// upstreamTransport selects the transport for a request by the upstream host
+type upstreamTransport struct {
+	hosts     []upstreamHost
+	def       *http.Transport
+	mu        sync.Mutex
+	overrides map[upstreamOverride]*upstreamOverrideT
+	seq       uint64 // incremented on each use of an override to find the least recently used
+}
+
+// upstreamOverride is a transport dialing a fixed address, separate transports avoid sharing pooled connections
+type upstreamOverride struct {
+	t    *http.Transport
+	addr string
+}
+
+type upstreamOverrideT struct {
+	t    *http.Transport
+	used uint64
+}
+
+// upstreamOverrideMax limits the override transports kept, the least recently used is closed when exceeded
+const upstreamOverrideMax = 64
+
+// upstreamAddrsKey holds the address overrides of the token in the request context
+type upstreamAddrsKey struct{}
+
+var upstreamDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+type upstreamHost struct {
+	pattern  string
+	t        *http.Transport
+	identity *storageMetaClientCert
+}
+
+// newUpstreamTransport returns a transport with the trust roots and host settings from the config
+func newUpstreamTransport(conf config.Proxy) (*upstreamTransport, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.TLSClientConfig = &tls.Config{}
+	if len(conf.UpstreamCA) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range conf.UpstreamCA {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read upstream CA: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in upstream CA %s", file)
+			}
+		}
+		base.TLSClientConfig.RootCAs = pool
+	}
+	ut := upstreamTransport{
+		def:       base,
+		hosts:     []upstreamHost{},
+		overrides: map[upstreamOverride]*upstreamOverrideT{},
+	}
+	for _, h := range conf.Hosts {
+		t := base.Clone()
+		t.TLSClientConfig.InsecureSkipVerify = h.TLSInsecure
+		if h.Addr != "" {
+			t.DialContext = dialAddr(h.Addr)
+		}
+		uh := upstreamHost{
+			pattern: h.Host,
+			t:       t,
+		}
+		if h.ClientCert != "" || h.ClientKey != "" {
+			cert, identity, err := loadClientCert(h.ClientCert, h.ClientKey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate for %s: %w", h.Host, err)
+			}
+			t.TLSClientConfig.Certificates = []tls.Certificate{cert}
+			uh.identity = identity
+		}
+		ut.hosts = append(ut.hosts, uh)
+	}
+	return &ut, nil
+}
+
+// loadClientCert returns a client certificate and the identity it presents
+func loadClientCert(certFile, keyFile string) (tls.Certificate, *storageMetaClientCert, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return cert, nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, nil, err
+	}
+	fp, err := hasher.FromBytes(leaf.Raw)
+	if err != nil {
+		return cert, nil, err
+	}
+	return cert, &storageMetaClientCert{
+		Subject:     leaf.Subject.String(),
+		Fingerprint: fp,
+	}, nil
+}
+
+// RoundTrip sends the request with the transport of the first matching host
+func (ut *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := ut.def
+	if h := ut.host(req.URL.Hostname()); h != nil {
+		t = h.t
+	}
+	if addrs, ok := req.Context().Value(upstreamAddrsKey{}).(map[string]string); ok {
+		if addr, ok := addrs[strings.ToLower(req.URL.Hostname())]; ok {
+			t = ut.override(t, addr)
+		}
+	}
+	return t.RoundTrip(req)
+}
+
+// override returns a transport based on t that connects to addr
+func (ut *upstreamTransport) override(t *http.Transport, addr string) *http.Transport {
+	key := upstreamOverride{t: t, addr: addr}
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	ut.seq++
+	if o, ok := ut.overrides[key]; ok {
+		o.used = ut.seq
+		return o.t
+	}
+	if len(ut.overrides) >= upstreamOverrideMax {
+		var oldKey upstreamOverride
+		var old *upstreamOverrideT
+		for k, o := range ut.overrides {
+			if old == nil || o.used < old.used {
+				oldKey, old = k, o
+			}
+		}
+		delete(ut.overrides, oldKey)
+		// requests in progress keep their connections, idle connections are released
+		old.t.CloseIdleConnections()
+	}
+	tOverride := t.Clone()
+	tOverride.DialContext = dialAddr(addr)
+	ut.overrides[key] = &upstreamOverrideT{t: tOverride, used: ut.seq}
+	return tOverride
+}
+
+// upstreamContext adds the address overrides of a token to the context of an upstream request
+func upstreamContext(ctx context.Context, conf config.Token) context.Context {
+	if len(conf.Addrs) == 0 {
+		return ctx
+	}
+	addrs := make(map[string]string, len(conf.Addrs))
+	for host, addr := range conf.Addrs {
+		addrs[strings.ToLower(host)] = addr
+	}
+	return context.WithValue(ctx, upstreamAddrsKey{}, addrs)
+}
+
+// dialAddr returns a dialer that connects to addr in place of the requested address
+func dialAddr(addr string) func(ctx context.Context, network, reqAddr string) (net.Conn, error) {
+	return func(ctx context.Context, network, reqAddr string) (net.Conn, error) {
+		return upstreamDialer.DialContext(ctx, network, overrideAddr(addr, reqAddr))
+	}
+}
+
+// overrideAddr replaces the host of reqAddr, the port is also replaced when addr includes one
+func overrideAddr(addr, reqAddr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	_, port, err := net.SplitHostPort(reqAddr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// clientIdentity returns the client certificate configured for the host of a response, or nil when none is used,
+// certificates are only sent over tls so plain http responses never have an identity
+func (ut *upstreamTransport) clientIdentity(resp *http.Response) *storageMetaClientCert {
+	if resp.TLS == nil || resp.Request == nil {
+		return nil
+	}
+	if h := ut.host(resp.Request.URL.Hostname()); h != nil {
+		return h.identity
+	}
+	return nil
+}
+
+func (ut *upstreamTransport) host(host string) *upstreamHost {
+	if ut == nil {
+		return nil
+	}
+	for i, h := range ut.hosts {
+		if hostMatch(h.pattern, host) {
+			return &ut.hosts[i]
+		}
+	}
+	return nil
+}
+
+// tlsChain returns the fingerprints of the certificates presented by the upstream server
+func tlsChain(cs *tls.ConnectionState) []string {
+	if cs == nil || len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	chain := make([]string, 0, len(cs.PeerCertificates))
+	for _, cert := range cs.PeerCertificates {
+		fp, err := hasher.FromBytes(cert.Raw)
+		if err != nil {
+			continue
+		}
+		chain = append(chain, fp)
+	}
+	return chain
+}
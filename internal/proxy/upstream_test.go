@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
+)
+
+func TestUpstreamTransport(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	err := os.WriteFile(caFile, caPEM, 0644)
+	if err != nil {
+		t.Errorf("failed to write CA: %v", err)
+		return
+	}
+	emptyFile := filepath.Join(t.TempDir(), "empty.pem")
+	err = os.WriteFile(emptyFile, []byte{}, 0644)
+	if err != nil {
+		t.Errorf("failed to write CA: %v", err)
+		return
+	}
+	fp, err := hasher.FromBytes(ts.Certificate().Raw)
+	if err != nil {
+		t.Errorf("failed to hash cert: %v", err)
+		return
+	}
+
+	tests := []struct {
+		name            string
+		conf            config.Proxy
+		expectErr       bool
+		expectUntrusted bool
+	}{
+		{
+			name:            "system roots",
+			conf:            config.Proxy{},
+			expectUntrusted: true,
+		},
+		{
+			name: "upstream CA",
+			conf: config.Proxy{UpstreamCA: []string{caFile}},
+		},
+		{
+			name:      "empty CA",
+			conf:      config.Proxy{UpstreamCA: []string{emptyFile}},
+			expectErr: true,
+		},
+		{
+			name:      "missing CA",
+			conf:      config.Proxy{UpstreamCA: []string{filepath.Join(t.TempDir(), "missing.pem")}},
+			expectErr: true,
+		},
+		{
+			name: "insecure host",
+			conf: config.Proxy{Hosts: []config.Host{{Host: "127.0.0.*", TLSInsecure: true}}},
+		},
+		{
+			name:            "insecure other host",
+			conf:            config.Proxy{Hosts: []config.Host{{Host: "example.com", TLSInsecure: true}}},
+			expectUntrusted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut, err := newUpstreamTransport(tt.conf)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("transport did not fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("failed to create transport: %v", err)
+				return
+			}
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+				return
+			}
+			resp, err := ut.RoundTrip(req)
+			if tt.expectUntrusted {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("request with an untrusted certificate succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			chain := tlsChain(resp.TLS)
+			if len(chain) != 1 || chain[0] != fp {
+				t.Errorf("unexpected chain, expected %s, received %v", fp, chain)
+			}
+		})
+	}
+}
+
+func TestUpstreamClientCert(t *testing.T) {
+	// generate a self signed client certificate
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Errorf("failed to generate key: %v", err)
+		return
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "build-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Errorf("failed to create certificate: %v", err)
+		return
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Errorf("failed to marshal key: %v", err)
+		return
+	}
+	tempDir := t.TempDir()
+	certFile := filepath.Join(tempDir, "client.pem")
+	keyFile := filepath.Join(tempDir, "client.key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	if err != nil {
+		t.Errorf("failed to write certificate: %v", err)
+		return
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Errorf("failed to write key: %v", err)
+		return
+	}
+	fp, err := hasher.FromBytes(certDER)
+	if err != nil {
+		t.Errorf("failed to hash cert: %v", err)
+		return
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		host      config.Host
+		expectErr bool
+		expectOK  bool
+	}{
+		{
+			name:     "client cert",
+			host:     config.Host{Host: "127.0.0.1", TLSInsecure: true, ClientCert: certFile, ClientKey: keyFile},
+			expectOK: true,
+		},
+		{
+			name: "no client cert",
+			host: config.Host{Host: "127.0.0.1", TLSInsecure: true},
+		},
+		{
+			name: "client cert other host",
+			host: config.Host{Host: "*.example.com", TLSInsecure: true, ClientCert: certFile, ClientKey: keyFile},
+		},
+		{
+			name:      "missing key",
+			host:      config.Host{Host: "127.0.0.1", ClientCert: certFile},
+			expectErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut, err := newUpstreamTransport(config.Proxy{Hosts: []config.Host{tt.host}})
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("transport did not fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("failed to create transport: %v", err)
+				return
+			}
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+				return
+			}
+			resp, err := ut.RoundTrip(req)
+			if !tt.expectOK {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("request without a client certificate succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+			identity := ut.clientIdentity(resp)
+			if identity == nil || identity.Subject != "CN=build-client" || identity.Fingerprint != fp {
+				t.Errorf("unexpected identity: %v", identity)
+			}
+			// a plain http response from the same host did not send the certificate
+			respPlain := *resp
+			respPlain.TLS = nil
+			if identity := ut.clientIdentity(&respPlain); identity != nil {
+				t.Errorf("identity recorded without tls: %v", identity)
+			}
+		})
+	}
+}
+
+func TestOverrideAddr(t *testing.T) {
+	tests := []struct {
+		addr, reqAddr, expect string
+	}{
+		{addr: "10.0.0.1", reqAddr: "example.com:443", expect: "10.0.0.1:443"},
+		{addr: "mirror.local:8443", reqAddr: "example.com:443", expect: "mirror.local:8443"},
+		{addr: "::1", reqAddr: "example.com:80", expect: "[::1]:80"},
+		{addr: "[::1]", reqAddr: "example.com:80", expect: "[::1]:80"},
+		{addr: "[::1]:8080", reqAddr: "example.com:80", expect: "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			result := overrideAddr(tt.addr, tt.reqAddr)
+			if result != tt.expect {
+				t.Errorf("unexpected address, expected %s, received %s", tt.expect, result)
+			}
+		})
+	}
+}
+
+func TestUpstreamAddr(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Errorf("failed to parse listener address: %v", err)
+		return
+	}
+
+	tests := []struct {
+		name  string
+		conf  config.Proxy
+		token config.Token
+		url   string
+	}{
+		{
+			name: "config host",
+			conf: config.Proxy{Hosts: []config.Host{{Host: "*.mirror.invalid", Addr: "127.0.0.1"}}},
+			url:  "http://repo.mirror.invalid:" + port + "/file",
+		},
+		{
+			name: "config host with port",
+			conf: config.Proxy{Hosts: []config.Host{{Host: "repo.mirror.invalid", Addr: ts.Listener.Addr().String()}}},
+			url:  "http://repo.mirror.invalid/file",
+		},
+		{
+			name:  "token",
+			token: config.Token{Addrs: map[string]string{"Repo.Mirror.Invalid": "127.0.0.1"}},
+			url:   "http://repo.mirror.invalid:" + port + "/file",
+		},
+		{
+			name:  "token overrides config",
+			conf:  config.Proxy{Hosts: []config.Host{{Host: "repo.mirror.invalid", Addr: "127.0.0.2:1"}}},
+			token: config.Token{Addrs: map[string]string{"repo.mirror.invalid": ts.Listener.Addr().String()}},
+			url:   "http://repo.mirror.invalid/file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut, err := newUpstreamTransport(tt.conf)
+			if err != nil {
+				t.Errorf("failed to create transport: %v", err)
+				return
+			}
+			ctx := upstreamContext(context.Background(), tt.token)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+				return
+			}
+			resp, err := ut.RoundTrip(req)
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("failed to read body: %v", err)
+				return
+			}
+			// the request is unchanged, only the connection is redirected
+			if string(body) != req.URL.Host {
+				t.Errorf("unexpected host, expected %s, received %s", req.URL.Host, body)
+			}
+		})
+	}
+}
+
+func TestUpstreamOverrideLimit(t *testing.T) {
+	ut, err := newUpstreamTransport(config.Proxy{})
+	if err != nil {
+		t.Errorf("failed to create transport: %v", err)
+		return
+	}
+	first := ut.override(ut.def, "10.0.0.1")
+	for i := 0; i < upstreamOverrideMax*2; i++ {
+		ut.override(ut.def, fmt.Sprintf("10.1.%d.%d", i/256, i%256))
+		// the first override stays in use and is not evicted
+		if ut.override(ut.def, "10.0.0.1") != first {
+			t.Errorf("recently used override was evicted")
+			return
+		}
+	}
+	if len(ut.overrides) > upstreamOverrideMax {
+		t.Errorf("override transports exceed the limit, %d > %d", len(ut.overrides), upstreamOverrideMax)
+	}
+	if _, ok := ut.overrides[upstreamOverride{t: ut.def, addr: "10.1.0.0"}]; ok {
+		t.Errorf("least recently used override was not evicted")
+	}
+}
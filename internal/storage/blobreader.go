@@ -1,6 +1,12 @@
 package storage
 
-import "io"
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/httplock/httplock/hasher"
+)
 
 // BlobReader is used to read blobs
 type BlobReader interface {
@@ -42,3 +48,100 @@ func (br *blobRead) Seek(offset int64, whence int) (int64, error) {
 func (br *blobRead) Size() int64 {
 	return br.size
 }
+
+// ErrHashMismatch is returned at the end of a verified blob when the content does not match the hash
+var ErrHashMismatch = errors.New("blob hash mismatch")
+
+// verifyReader hashes the content as it is read, comparing the digest to the blob hash at EOF
+type verifyReader struct {
+	BlobReader
+	hash     string
+	algo     string
+	hr       *hasher.Reader
+	pos      int64
+	valid    bool
+	verified bool // full content has matched the hash
+}
+
+// newVerifyReader hashes the content with the algorithm of the blob hash
+func newVerifyReader(br BlobReader, hash string) (*verifyReader, error) {
+	algo, err := hasher.Algorithm(hash)
+	if err != nil {
+		return nil, err
+	}
+	hr, err := hasher.NewReaderAlgo(algo, br)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyReader{
+		BlobReader: br,
+		hash:       hash,
+		algo:       algo,
+		hr:         hr,
+		valid:      true,
+	}, nil
+}
+
+// Read passes through the read request, returning ErrHashMismatch in place of EOF if the content was modified
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	n, err := vr.hr.Read(p)
+	vr.pos += int64(n)
+	if errors.Is(err, io.EOF) && vr.valid {
+		if digest := vr.hr.String(); digest != vr.hash {
+			return n, fmt.Errorf("%w: expected %s, computed %s", ErrHashMismatch, vr.hash, digest)
+		}
+		vr.verified = true
+	}
+	return n, err
+}
+
+// Seek passes through the seek request, the full content is verified before the first seek
+// that leaves a sequential read, so ranges are not returned from a modified blob
+func (vr *verifyReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := vr.BlobReader.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	if pos == 0 {
+		vr.hr, err = hasher.NewReaderAlgo(vr.algo, vr.BlobReader)
+		if err != nil {
+			return pos, err
+		}
+		vr.valid = true
+	} else if pos != vr.pos {
+		vr.valid = false
+		if !vr.verified {
+			err = vr.verifyAll()
+			if err != nil {
+				return 0, err
+			}
+			_, err = vr.BlobReader.Seek(pos, io.SeekStart)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	vr.pos = pos
+	return pos, nil
+}
+
+// verifyAll hashes the full content, leaving the position at the end of the blob
+func (vr *verifyReader) verifyAll() error {
+	_, err := vr.BlobReader.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	hr, err := hasher.NewReaderAlgo(vr.algo, vr.BlobReader)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, hr)
+	if err != nil {
+		return err
+	}
+	if digest := hr.String(); digest != vr.hash {
+		return fmt.Errorf("%w: expected %s, computed %s", ErrHashMismatch, vr.hash, digest)
+	}
+	vr.verified = true
+	return nil
+}
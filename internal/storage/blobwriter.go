@@ -3,8 +3,10 @@ package storage
 import (
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
 )
 
 // BlobWriter is used when writing blobs
@@ -15,23 +17,71 @@ type BlobWriter interface {
 }
 
 type blobWrite struct {
+	mu      sync.Mutex
 	orig    io.Writer
 	closed  bool
 	closeFn closeFn
 	hash    *hasher.Writer
 }
 
+// BlobOpt configures a blob writer
+type BlobOpt func(*blobOpts)
+
+type blobOpts struct {
+	algo string
+}
+
+// WithAlgorithm hashes the blob with the algorithm instead of the storage default,
+// used when copying a blob that must keep its existing hash
+func WithAlgorithm(algo string) BlobOpt {
+	return func(bo *blobOpts) {
+		bo.algo = algo
+	}
+}
+
+// newAlgorithm validates the configured hash algorithm of a storage, empty selects the default
+func newAlgorithm(c config.Storage) (string, error) {
+	if c.Hash != "" && !hasher.Supported(c.Hash) {
+		return "", fmt.Errorf("unsupported hash algorithm %q", c.Hash)
+	}
+	return c.Hash, nil
+}
+
+// blobAlgorithm returns the hash algorithm for a new blob, preferring the algorithm from the options over the storage default
+func blobAlgorithm(def string, opts []BlobOpt) (string, error) {
+	bo := blobOpts{}
+	for _, opt := range opts {
+		opt(&bo)
+	}
+	if bo.algo == "" {
+		bo.algo = def
+	}
+	if bo.algo == "" {
+		return hasher.Default, nil
+	}
+	if !hasher.Supported(bo.algo) {
+		return "", fmt.Errorf("unsupported hash algorithm %q", bo.algo)
+	}
+	return bo.algo, nil
+}
+
 type closeFn func(hash string) error
 
-func newBlobWriter(w io.Writer, cfn closeFn) *blobWrite {
+func newBlobWriter(w io.Writer, algo string, cfn closeFn) (*blobWrite, error) {
+	hw, err := hasher.NewWriterAlgo(algo, w)
+	if err != nil {
+		return nil, err
+	}
 	return &blobWrite{
 		orig:    w,
-		hash:    hasher.NewWriter(w),
+		hash:    hw,
 		closeFn: cfn,
-	}
+	}, nil
 }
 
 func (bw *blobWrite) Close() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
 	if bw.closed {
 		return nil
 	}
@@ -61,6 +111,8 @@ func (bw *blobWrite) Close() error {
 }
 
 func (bw *blobWrite) Hash() (string, error) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
 	if !bw.closed {
 		return "", fmt.Errorf("hash unavailable, writer is not closed")
 	}
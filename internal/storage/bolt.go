@@ -0,0 +1,448 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/httplock/httplock/internal/config"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt storage keeps small blobs and the index in a single database file, large blobs use the filesystem layout
+
+const (
+	boltFilename   = "httplock.db"
+	boltInlineSize = 64 * 1024 // blobs up to this size are stored in the database
+)
+
+var (
+	boltBucketBlobs   = []byte("blobs")
+	boltBucketEncoded = []byte("blobs-encoded") // inline blobs written with a codec
+	boltBucketIndex   = []byte("index")
+)
+
+func init() {
+	Register("bolt", func(c config.Config) (Storage, error) {
+		cd, err := newCodec(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		algo, err := newAlgorithm(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		return newBolt(c.Storage.Directory, cd, algo, c.Storage.Verify)
+	})
+}
+
+type BoltStorage struct {
+	mu     sync.Mutex
+	dir    string
+	db     *bolt.DB
+	index  Index
+	roots  map[string]*Root
+	cd     *codec
+	algo   string // hash algorithm of new blobs, empty for the default
+	verify bool   // rehash blobs as they are read
+}
+
+func NewBolt(dir string) (Storage, error) {
+	return newBolt(dir, nil, "", false)
+}
+
+func newBolt(dir string, cd *codec, algo string, verify bool) (Storage, error) {
+	for _, sub := range []string{fsTmpDir, fsBlobDir} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0777)
+		if err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(filepath.Join(dir, boltFilename), 0666, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", boltFilename, err)
+	}
+	b := BoltStorage{
+		dir: dir,
+		db:  db,
+		index: Index{
+			Roots: map[string]*IndexRoot{},
+		},
+		roots:  map[string]*Root{},
+		cd:     cd,
+		algo:   algo,
+		verify: verify,
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketBlobs, boltBucketEncoded} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		bucketIndex, err := tx.CreateBucketIfNotExists(boltBucketIndex)
+		if err != nil {
+			return err
+		}
+		return bucketIndex.ForEach(func(k, v []byte) error {
+			ir := IndexRoot{}
+			if err := json.Unmarshal(v, &ir); err != nil {
+				return fmt.Errorf("failed to parse index entry %s: %w", k, err)
+			}
+			b.index.Roots[string(k)] = &ir
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &b, nil
+}
+
+// BlobOpen returns a reader for a blob
+func (b *BoltStorage) BlobOpen(blob string) (BlobReader, error) {
+	bb, encoded, err := b.blobInline(blob)
+	if err != nil {
+		return nil, err
+	}
+	var br BlobReader
+	if bb != nil {
+		br, err = b.cd.reader(bytes.NewReader(bb), int64(len(bb)), encoded)
+	} else {
+		br, err = fsBlobOpen(b.dir, blob, b.cd)
+	}
+	if err != nil || !b.verify {
+		return br, err
+	}
+	vr, err := newVerifyReader(br, blob)
+	if err != nil {
+		br.Close()
+		return nil, err
+	}
+	return vr, nil
+}
+
+// blobSize returns the size of a blob, inline or in the blob directory
+func (b *BoltStorage) blobSize(hash string) (int64, error) {
+	bb, encoded, err := b.blobInline(hash)
+	if err != nil {
+		return 0, err
+	}
+	if bb == nil {
+		return fsBlobSize(b.dir, hash)
+	}
+	if encoded {
+		return codecSize(bytes.NewReader(bb))
+	}
+	return int64(len(bb)), nil
+}
+
+// blobInline returns a copy of an inline blob and whether it was written with a codec, nil when the blob is not inline
+func (b *BoltStorage) blobInline(blob string) ([]byte, bool, error) {
+	var bb []byte
+	encoded := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketEncoded, boltBucketBlobs} {
+			v := tx.Bucket(name).Get([]byte(blob))
+			if v != nil {
+				// values are only valid during the transaction
+				bb = make([]byte, len(v))
+				copy(bb, v)
+				encoded = bytes.Equal(name, boltBucketEncoded)
+				return nil
+			}
+		}
+		return nil
+	})
+	return bb, encoded, err
+}
+
+// BlobCreate returns a writer for a blob
+func (b *BoltStorage) BlobCreate(opts ...BlobOpt) (BlobWriter, error) {
+	algo, err := blobAlgorithm(b.algo, opts)
+	if err != nil {
+		return nil, err
+	}
+	sw := &boltSpillWriter{
+		dir: filepath.Join(b.dir, fsTmpDir),
+	}
+	w, err := b.cd.writer(sw)
+	if err != nil {
+		return nil, err
+	}
+	encoded := b.cd != nil
+	bucket := boltBucketBlobs
+	if encoded {
+		bucket = boltBucketEncoded
+	}
+	bw, err := newBlobWriter(w, algo, func(hash string) error {
+		if sw.fh == nil {
+			return b.db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket(bucket).Put([]byte(hash), sw.buf.Bytes())
+			})
+		}
+		return fsRename(sw.fh.Name(), b.dir, hash, encoded)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+// Flush writes any data cached to the backend storage
+func (b *BoltStorage) Flush() error {
+	// noop, each transaction is synced to disk when committed
+	return nil
+}
+
+// Index returns the current index
+func (b *BoltStorage) Index() Index {
+	return b.index
+}
+
+// Close releases the database file
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
+
+// PruneCache deletes any data from memory or cache that hasn't been recently accessed
+func (b *BoltStorage) PruneCache(time.Duration) error {
+	return ErrNotImplemented
+}
+
+// PruneStorage deletes any blobs that are not used by any root
+func (b *BoltStorage) PruneStorage() error {
+	return ErrNotImplemented
+}
+
+// RootCreate returns a new root using a uuid
+func (b *BoltStorage) RootCreate() (string, *Root, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := fmt.Sprintf("uuid:%s", uuid.New().String())
+	root := newRoot(b)
+	b.roots[u] = root
+	return u, root, nil
+}
+
+// RootCreateFrom returns a new root using a uuid initialized from an existing hash
+func (b *BoltStorage) RootCreateFrom(hash string) (string, *Root, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := fmt.Sprintf("uuid:%s", uuid.New().String())
+	if _, ok := b.index.Roots[hash]; !ok {
+		return "", nil, fmt.Errorf("hash not found in index: %s", hash)
+	}
+	root := newRootHash(b, hash)
+	root.readonly = false
+	root.metaHash = b.index.Roots[hash].Meta
+	b.roots[u] = root
+	return u, root, nil
+}
+
+// RootOpen returns an existing root
+func (b *BoltStorage) RootOpen(name string) (*Root, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if root, ok := b.roots[name]; ok {
+		return root, nil
+	}
+	if _, ok := b.index.Roots[name]; !ok {
+		return nil, fmt.Errorf("hash not found in index: %s", name)
+	}
+	b.index.Roots[name].Used = time.Now()
+	root := newRootHash(b, name)
+	root.metaHash = b.index.Roots[name].Meta
+	b.roots[name] = root
+	return root, nil
+}
+
+// rootUsed updates the last used time of a root in the index
+func (b *BoltStorage) rootUsed(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ir, ok := b.index.Roots[name]; ok {
+		ir.Used = time.Now()
+	}
+}
+
+// RootSave saves a root and adds the hash to the index
+func (b *BoltStorage) RootSave(r *Root) (string, error) {
+	hash, err := r.Save()
+	if err != nil {
+		return "", err
+	}
+	metaHash, err := r.saveMeta()
+	if err != nil {
+		return "", err
+	}
+	ir := r.indexRoot(metaHash)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ir.merge(b.index.Roots[hash])
+	irBytes, err := json.Marshal(ir)
+	if err != nil {
+		return "", err
+	}
+	// the index is only updated in memory after the transaction commits
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketIndex).Put([]byte(hash), irBytes)
+	})
+	if err != nil {
+		return "", err
+	}
+	newRoot := newRootHash(b, hash)
+	newRoot.metaHash = metaHash
+	b.roots[hash] = newRoot
+	b.index.Roots[hash] = &ir
+	return hash, nil
+}
+
+// blobList returns the hash of every blob, both inline and in the blob directory
+func (b *BoltStorage) blobList() ([]string, error) {
+	hashes := []string{}
+	seen := map[string]bool{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketBlobs, boltBucketEncoded} {
+			err := tx.Bucket(name).ForEach(func(k, v []byte) error {
+				if !seen[string(k)] {
+					seen[string(k)] = true
+					hashes = append(hashes, string(k))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fsHashes, err := fsBlobList(b.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range fsHashes {
+		if !seen[hash] {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, nil
+}
+
+// blobDelete removes a blob
+func (b *BoltStorage) blobDelete(hash string) error {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketBlobs, boltBucketEncoded} {
+			bucket := tx.Bucket(name)
+			if bucket.Get([]byte(hash)) == nil {
+				continue
+			}
+			found = true
+			if err := bucket.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil || found {
+		return err
+	}
+	return fsBlobRemove(b.dir, hash)
+}
+
+// blobQuarantine moves a blob into the quarantine directory
+func (b *BoltStorage) blobQuarantine(hash string) error {
+	inline, encoded, err := b.blobInline(hash)
+	if err != nil {
+		return err
+	}
+	if inline == nil {
+		return fsQuarantine(b.dir, hash)
+	}
+	// inline blobs are written to the blob directory before being moved aside
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return err
+	}
+	if encoded {
+		blobPath += fsCodecExt
+	}
+	err = os.MkdirAll(filepath.Dir(filepath.Join(b.dir, blobPath)), 0777)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(b.dir, blobPath), inline, 0666)
+	if err != nil {
+		return err
+	}
+	err = fsQuarantine(b.dir, hash)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketBlobs, boltBucketEncoded} {
+			if err := tx.Bucket(name).Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltSpillWriter buffers small blobs in memory and moves larger blobs to a temp file
+type boltSpillWriter struct {
+	dir string
+	buf bytes.Buffer
+	fh  *os.File
+}
+
+func (sw *boltSpillWriter) Write(p []byte) (int, error) {
+	if sw.fh == nil && sw.buf.Len()+len(p) > boltInlineSize {
+		fh, err := os.CreateTemp(sw.dir, "*")
+		if err != nil {
+			return 0, err
+		}
+		sw.fh = fh
+		if _, err := fh.Write(sw.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		sw.buf = bytes.Buffer{}
+	}
+	if sw.fh != nil {
+		return sw.fh.Write(p)
+	}
+	return sw.buf.Write(p)
+}
+
+// WriteAt updates previously written content
+func (sw *boltSpillWriter) WriteAt(p []byte, off int64) (int, error) {
+	if sw.fh != nil {
+		return sw.fh.WriteAt(p, off)
+	}
+	if off < 0 || off+int64(len(p)) > int64(sw.buf.Len()) {
+		return 0, fmt.Errorf("write at %d beyond buffer length %d", off, sw.buf.Len())
+	}
+	return copy(sw.buf.Bytes()[off:], p), nil
+}
+
+func (sw *boltSpillWriter) Close() error {
+	if sw.fh == nil {
+		return nil
+	}
+	err := sw.fh.Close()
+	if err != nil && !errors.Is(err, fs.ErrClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBolt(t *testing.T) {
+	dir := t.TempDir()
+	blobSmall := []byte("small blob")
+	blobLarge := bytes.Repeat([]byte("large blob "), boltInlineSize/5)
+	s, err := NewBolt(dir)
+	if err != nil {
+		t.Errorf("failed to open storage: %v", err)
+		return
+	}
+	_, r, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	for name, content := range map[string][]byte{"small": blobSmall, "large": blobLarge} {
+		bw, err := r.Write([]string{"dir", name})
+		if err != nil {
+			t.Errorf("failed to create writer: %v", err)
+			return
+		}
+		_, err = bw.Write(content)
+		if err != nil {
+			t.Errorf("failed to write blob: %v", err)
+			return
+		}
+		err = bw.Close()
+		if err != nil {
+			t.Errorf("failed to close blob: %v", err)
+			return
+		}
+	}
+	r.SetInfo(RootInfo{Labels: map[string]string{"branch": "main"}, Description: "bolt test"})
+	hash, err := s.RootSave(r)
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+	hashLarge, err := r.EntryHash([]string{"dir", "large"})
+	if err != nil {
+		t.Errorf("failed to get hash: %v", err)
+		return
+	}
+	hashSmall, err := r.EntryHash([]string{"dir", "small"})
+	if err != nil {
+		t.Errorf("failed to get hash: %v", err)
+		return
+	}
+	err = s.(*BoltStorage).Close()
+	if err != nil {
+		t.Errorf("failed to close storage: %v", err)
+		return
+	}
+	// only large blobs are written as files
+	pathLarge, err := fsBlobPath(hashLarge)
+	if err != nil {
+		t.Errorf("failed to get blob path: %v", err)
+		return
+	}
+	pathSmall, err := fsBlobPath(hashSmall)
+	if err != nil {
+		t.Errorf("failed to get blob path: %v", err)
+		return
+	}
+	if _, err := os.Stat(filepath.Join(dir, pathLarge)); err != nil {
+		t.Errorf("large blob file missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, pathSmall)); err == nil {
+		t.Errorf("small blob was written to a file")
+	}
+
+	// reopen and verify the index and blobs
+	s, err = NewBolt(dir)
+	if err != nil {
+		t.Errorf("failed to reopen storage: %v", err)
+		return
+	}
+	defer s.(*BoltStorage).Close()
+	if ir, ok := s.Index().Roots[hash]; !ok {
+		t.Errorf("root %s missing from index after reopen", hash)
+	} else if ir.Labels["branch"] != "main" || ir.Description != "bolt test" || ir.Created.IsZero() {
+		t.Errorf("root info not saved in index: %v", ir.RootInfo)
+	}
+	rSaved, err := s.RootOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open root: %v", err)
+		return
+	}
+	for name, content := range map[string][]byte{"small": blobSmall, "large": blobLarge} {
+		br, err := rSaved.Read([]string{"dir", name})
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+			return
+		}
+		b, err := io.ReadAll(br)
+		br.Close()
+		if err != nil {
+			t.Errorf("failed to read %s: %v", name, err)
+			return
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("content mismatch on %s", name)
+		}
+		if br.Size() != int64(len(content)) {
+			t.Errorf("size mismatch on %s, expected %d, received %d", name, len(content), br.Size())
+		}
+	}
+}
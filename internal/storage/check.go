@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+
+	"github.com/httplock/httplock/hasher"
+)
+
+const (
+	CheckMissing  = "missing"  // blob is not in storage
+	CheckCorrupt  = "corrupt"  // blob content does not match the hash
+	CheckOrphaned = "orphaned" // directory entry cannot be followed, its children are unreachable
+)
+
+// CheckOpts configures the storage check
+type CheckOpts struct {
+	Quarantine bool // remove corrupt blobs from storage, moving them aside when the backend supports it
+}
+
+// CheckReport lists the problems found in storage
+type CheckReport struct {
+	Roots    int            `json:"roots"`
+	Blobs    int            `json:"blobs"`
+	Problems []CheckProblem `json:"problems"`
+}
+
+// CheckProblem describes a blob that failed verification
+type CheckProblem struct {
+	Kind        string   `json:"kind"`
+	Root        string   `json:"root"`
+	Path        []string `json:"path"`
+	Hash        string   `json:"hash"`
+	Err         string   `json:"error,omitempty"`
+	Quarantined bool     `json:"quarantined,omitempty"`
+}
+
+// blobQuarantiner is implemented by storage that can move a blob aside for inspection
+type blobQuarantiner interface {
+	blobQuarantine(hash string) error
+}
+
+type checkEntry struct {
+	path []string
+	hash string
+	kind EntryKind
+}
+
+// ErrQuarantineUnsupported is returned when quarantine is requested on storage that cannot remove blobs
+var ErrQuarantineUnsupported = errors.New("quarantine is not supported by the storage")
+
+// Check walks every root in the index, rehashing each blob to verify the content matches the hash
+func Check(s Storage, opts CheckOpts) (CheckReport, error) {
+	report := CheckReport{
+		Problems: []CheckProblem{},
+	}
+	if opts.Quarantine && !checkCanQuarantine(s) {
+		return report, ErrQuarantineUnsupported
+	}
+	// each blob is only verified once, problems are reported for every root and path using it
+	results := map[string]*CheckProblem{}
+	// verified directories are walked again for each root that references them
+	dirs := map[string]*Dir{}
+	quarantined := map[string]error{}
+	ind := s.Index()
+	rootHashes := make([]string, 0, len(ind.Roots))
+	for hash := range ind.Roots {
+		rootHashes = append(rootHashes, hash)
+	}
+	sort.Strings(rootHashes)
+	for _, rootHash := range rootHashes {
+		report.Roots++
+		entries := []checkEntry{{path: []string{}, hash: rootHash, kind: KindDir}}
+		if meta := ind.Roots[rootHash].Meta; meta != "" {
+			entries = append(entries, checkEntry{path: []string{}, hash: meta, kind: KindFile})
+		}
+		for len(entries) > 0 {
+			entry := entries[0]
+			entries = entries[1:]
+			result, ok := results[entry.hash]
+			if !ok {
+				report.Blobs++
+				var content []byte
+				content, result = checkBlob(s, entry.hash, entry.kind == KindDir)
+				if result == nil && entry.kind == KindDir {
+					d := Dir{}
+					err := json.Unmarshal(content, &d)
+					if err != nil {
+						result = &CheckProblem{
+							Kind: CheckOrphaned,
+							Hash: entry.hash,
+							Err:  fmt.Sprintf("invalid directory: %v", err),
+						}
+					} else {
+						dirs[entry.hash] = &d
+					}
+				}
+				results[entry.hash] = result
+			}
+			if result != nil {
+				problem := *result
+				problem.Root = rootHash
+				problem.Path = entry.path
+				if opts.Quarantine && problem.Kind == CheckCorrupt {
+					if _, ok := quarantined[entry.hash]; !ok {
+						quarantined[entry.hash] = checkQuarantine(s, entry.hash)
+					}
+					if err := quarantined[entry.hash]; err != nil {
+						problem.Err = fmt.Sprintf("%s, quarantine failed: %v", problem.Err, err)
+					} else {
+						problem.Quarantined = true
+					}
+				}
+				report.Problems = append(report.Problems, problem)
+				continue
+			}
+			d, ok := dirs[entry.hash]
+			if entry.kind != KindDir || !ok {
+				continue
+			}
+			for _, name := range d.keys() {
+				de := d.Entries[name]
+				path := append(append([]string{}, entry.path...), name)
+				if de == nil || de.Hash == "" || (de.Kind != KindDir && de.Kind != KindFile) {
+					problem := CheckProblem{
+						Kind: CheckOrphaned,
+						Root: rootHash,
+						Path: path,
+						Err:  "invalid directory entry",
+					}
+					if de != nil {
+						problem.Hash = de.Hash
+					}
+					report.Problems = append(report.Problems, problem)
+					continue
+				}
+				entries = append(entries, checkEntry{path: path, hash: de.Hash, kind: de.Kind})
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkBlob reads and rehashes a blob, returning the content when keep is set
+func checkBlob(s Storage, hash string, keep bool) ([]byte, *CheckProblem) {
+	br, err := s.BlobOpen(hash)
+	if err != nil {
+		kind := CheckCorrupt
+		if errors.Is(err, fs.ErrNotExist) {
+			kind = CheckMissing
+		}
+		return nil, &CheckProblem{Kind: kind, Hash: hash, Err: err.Error()}
+	}
+	defer br.Close()
+	algo, err := hasher.Algorithm(hash)
+	if err != nil {
+		return nil, &CheckProblem{Kind: CheckCorrupt, Hash: hash, Err: err.Error()}
+	}
+	hr, err := hasher.NewReaderAlgo(algo, br)
+	if err != nil {
+		return nil, &CheckProblem{Kind: CheckCorrupt, Hash: hash, Err: err.Error()}
+	}
+	buf := bytes.Buffer{}
+	var w io.Writer = io.Discard
+	if keep {
+		w = &buf
+	}
+	_, err = io.Copy(w, hr)
+	if err != nil {
+		return nil, &CheckProblem{Kind: CheckCorrupt, Hash: hash, Err: err.Error()}
+	}
+	if hr.String() != hash {
+		return nil, &CheckProblem{Kind: CheckCorrupt, Hash: hash, Err: fmt.Sprintf("content hash is %s", hr.String())}
+	}
+	return buf.Bytes(), nil
+}
+
+// checkCanQuarantine returns true when the storage can remove corrupt blobs
+func checkCanQuarantine(s Storage) bool {
+	switch s.(type) {
+	case blobQuarantiner, blobCache:
+		return true
+	}
+	return false
+}
+
+// checkQuarantine moves a corrupt blob aside, or deletes it when the storage cannot keep a copy
+func checkQuarantine(s Storage, hash string) error {
+	if bq, ok := s.(blobQuarantiner); ok {
+		return bq.blobQuarantine(hash)
+	}
+	if bc, ok := s.(blobCache); ok {
+		return bc.blobDelete(hash)
+	}
+	return ErrNotImplemented
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFilesystem(dir)
+	if err != nil {
+		t.Errorf("failed to create storage: %v", err)
+		return
+	}
+	_, root, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	files := map[string]string{
+		"good":    "good content",
+		"corrupt": "corrupt content",
+		"missing": "missing content",
+	}
+	hashes := map[string]string{}
+	for name, content := range files {
+		bw, err := root.Write([]string{"dir", name})
+		if err != nil {
+			t.Errorf("failed to create blob: %v", err)
+			return
+		}
+		_, err = bw.Write([]byte(content))
+		if err != nil {
+			t.Errorf("failed to write blob: %v", err)
+			return
+		}
+		bw.Close()
+		hashes[name], err = bw.Hash()
+		if err != nil {
+			t.Errorf("failed to get hash: %v", err)
+			return
+		}
+	}
+	hash, err := s.RootSave(root)
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+	// a second root shares the directory with the first
+	_, root2, err := s.RootCreateFrom(hash)
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	bw, err := root2.Write([]string{"other"})
+	if err != nil {
+		t.Errorf("failed to create blob: %v", err)
+		return
+	}
+	_, err = bw.Write([]byte("other content"))
+	if err != nil {
+		t.Errorf("failed to write blob: %v", err)
+		return
+	}
+	bw.Close()
+	_, err = s.RootSave(root2)
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+
+	report, err := Check(s, CheckOpts{})
+	if err != nil {
+		t.Errorf("check failed: %v", err)
+		return
+	}
+	if len(report.Problems) != 0 || report.Roots != 2 || report.Blobs != 7 {
+		t.Errorf("unexpected report on valid storage: %v", report)
+	}
+
+	// modify and delete blobs on disk
+	blobPath, _ := fsBlobPath(hashes["corrupt"])
+	err = os.WriteFile(filepath.Join(dir, blobPath), []byte("modified"), 0666)
+	if err != nil {
+		t.Errorf("failed to modify blob: %v", err)
+		return
+	}
+	blobPath, _ = fsBlobPath(hashes["missing"])
+	err = os.Remove(filepath.Join(dir, blobPath))
+	if err != nil {
+		t.Errorf("failed to remove blob: %v", err)
+		return
+	}
+	report, err = Check(s, CheckOpts{Quarantine: true})
+	if err != nil {
+		t.Errorf("check failed: %v", err)
+		return
+	}
+	// problems in the shared directory are reported for both roots
+	if len(report.Problems) != 4 {
+		t.Errorf("expected 4 problems, received %v", report.Problems)
+		return
+	}
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].Kind < report.Problems[j].Kind
+	})
+	expect := []struct {
+		kind        string
+		name        string
+		quarantined bool
+	}{
+		{kind: CheckCorrupt, name: "corrupt", quarantined: true},
+		{kind: CheckCorrupt, name: "corrupt", quarantined: true},
+		{kind: CheckMissing, name: "missing"},
+		{kind: CheckMissing, name: "missing"},
+	}
+	for i, e := range expect {
+		p := report.Problems[i]
+		if p.Kind != e.kind || p.Hash != hashes[e.name] || p.Quarantined != e.quarantined ||
+			len(p.Path) != 2 || p.Path[1] != e.name {
+			t.Errorf("unexpected problem, expected %s %s, received %v", e.kind, e.name, p)
+		}
+	}
+	if report.Problems[0].Root == report.Problems[1].Root || report.Problems[2].Root == report.Problems[3].Root {
+		t.Errorf("problems are not reported for each root: %v", report.Problems)
+	}
+	_, err = os.Stat(filepath.Join(dir, fsQuarantineDir, "sha256", hashes["corrupt"][len("sha256:"):]))
+	if err != nil {
+		t.Errorf("corrupt blob not found in quarantine: %v", err)
+	}
+	report, err = Check(s, CheckOpts{})
+	if err != nil {
+		t.Errorf("check failed: %v", err)
+		return
+	}
+	for _, p := range report.Problems {
+		if p.Hash == hashes["corrupt"] && p.Kind != CheckMissing {
+			t.Errorf("quarantined blob is not missing: %v", p)
+		}
+	}
+}
+
+func TestCheckQuarantineUnsupported(t *testing.T) {
+	local, _ := NewMemory()
+	remote, _ := NewMemory()
+	s, err := NewTiered(local, remote, false)
+	if err != nil {
+		t.Errorf("failed to create storage: %v", err)
+		return
+	}
+	_, err = Check(s, CheckOpts{Quarantine: true})
+	if !errors.Is(err, ErrQuarantineUnsupported) {
+		t.Errorf("quarantine on tiered storage was not rejected: %v", err)
+	}
+	_, err = Check(s, CheckOpts{})
+	if err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
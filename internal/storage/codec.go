@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/httplock/httplock/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Blobs written with a codec begin with a header:
+// magic (8 bytes), compression (1 byte), logical size (8 bytes, big endian)
+// the logical size is written when the blob is closed
+// the high bit of the compression byte indicates the blob is encrypted, see encrypt.go
+// storage records which blobs were written with a codec, blobs written without one are read unchanged
+
+var codecMagic = []byte("\x89HLBLOB\n")
+
+const (
+	codecHeaderLen = 17
+	codecSizeOff   = 9
+)
+
+const (
+	compressNone byte = iota
+	compressGzip
+	compressZstd
+)
+
+const codecEncrypted byte = 0x80
+
+var errCodecHeader = errors.New("blob is missing the codec header")
+
+// codec encodes blobs written to storage
+type codec struct {
+	compress byte
+	keys     *encryptKeys
+}
+
+// writerAt is used to update the header after the blob is written
+type writerAt interface {
+	io.Writer
+	io.WriterAt
+}
+
+func newCodec(c config.Storage) (*codec, error) {
+	cd := codec{}
+	switch c.Compression {
+	case "", "none":
+	case "gzip":
+		cd.compress = compressGzip
+	case "zstd":
+		cd.compress = compressZstd
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c.Compression)
+	}
+	keys, err := newEncryptKeys(c.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if cd.compress == compressNone && keys == nil {
+		return nil, nil
+	}
+	cd.keys = keys
+	return &cd, nil
+}
+
+// writer returns a writer that encodes blobs, w is returned unchanged when no codec is configured
+func (cd *codec) writer(w writerAt) (io.Writer, error) {
+	if cd == nil {
+		return w, nil
+	}
+	header := make([]byte, codecHeaderLen)
+	copy(header, codecMagic)
+	header[len(codecMagic)] = cd.compress
+	if cd.keys != nil {
+		header[len(codecMagic)] |= codecEncrypted
+	}
+	_, err := w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	cw := codecWriter{
+		orig: w,
+	}
+	var dst io.Writer = w
+	if cd.keys != nil {
+		cw.enc, err = newEncryptWriter(w, cd.keys)
+		if err != nil {
+			return nil, err
+		}
+		dst = cw.enc
+	}
+	switch cd.compress {
+	case compressNone:
+		cw.w = nopWriteCloser{dst}
+	case compressGzip:
+		cw.w = gzip.NewWriter(dst)
+	case compressZstd:
+		zw, err := zstd.NewWriter(dst)
+		if err != nil {
+			return nil, err
+		}
+		cw.w = zw
+	}
+	return &cw, nil
+}
+
+type codecWriter struct {
+	orig writerAt
+	w    io.WriteCloser
+	enc  *encryptWriter
+	size int64
+}
+
+func (cw *codecWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.size += int64(n)
+	return n, err
+}
+
+// Close flushes the encoder and updates the header with the logical size
+func (cw *codecWriter) Close() error {
+	errs := []error{cw.w.Close()}
+	if cw.enc != nil {
+		errs = append(errs, cw.enc.finish(cw.size))
+	}
+	sizeBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(sizeBytes, uint64(cw.size))
+	_, err := cw.orig.WriteAt(sizeBytes, codecSizeOff)
+	errs = append(errs, err)
+	if c, ok := cw.orig.(io.Closer); ok {
+		errs = append(errs, c.Close())
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// reader returns a reader for a blob, encoded is set by the storage for blobs written with a codec,
+// the format is never detected from the content since raw blobs may begin with the header,
+// a nil codec can decode compressed blobs but not encrypted blobs
+func (cd *codec) reader(rdr io.ReadSeeker, size int64, encoded bool) (BlobReader, error) {
+	if !encoded {
+		return newBlobReader(rdr, size)
+	}
+	header := make([]byte, codecHeaderLen)
+	_, err := io.ReadFull(rdr, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	if err != nil || !bytes.Equal(header[:len(codecMagic)], codecMagic) {
+		return nil, errCodecHeader
+	}
+	cr := codecReader{
+		orig:     rdr,
+		compress: header[len(codecMagic)] &^ codecEncrypted,
+		size:     int64(binary.BigEndian.Uint64(header[codecSizeOff:])),
+		dataOff:  codecHeaderLen,
+	}
+	if header[len(codecMagic)]&codecEncrypted != 0 {
+		var keys *encryptKeys
+		if cd != nil {
+			keys = cd.keys
+		}
+		var n int64
+		cr.aead, cr.prefix, n, err = readEncryptHeader(rdr, keys)
+		if err != nil {
+			return nil, err
+		}
+		cr.dataOff += n
+	}
+	err = cr.reset()
+	if err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+// codecSize returns the logical size from the header of an encoded blob without decoding the content
+func codecSize(rdr io.ReaderAt) (int64, error) {
+	header := make([]byte, codecHeaderLen)
+	n, err := rdr.ReadAt(header, 0)
+	if n < len(header) && err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if n < len(header) || !bytes.Equal(header[:len(codecMagic)], codecMagic) {
+		return 0, errCodecHeader
+	}
+	return int64(binary.BigEndian.Uint64(header[codecSizeOff:])), nil
+}
+
+// codecReader decodes a blob, seeking backwards restarts the decoder
+type codecReader struct {
+	orig     io.ReadSeeker
+	compress byte
+	size     int64
+	pos      int64
+	dataOff  int64
+	aead     cipher.AEAD
+	prefix   []byte
+	r        io.Reader
+	zr       *zstd.Decoder
+}
+
+func (cr *codecReader) reset() error {
+	_, err := cr.orig.Seek(cr.dataOff, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	cr.pos = 0
+	var src io.Reader = cr.orig
+	if cr.aead != nil {
+		src = newDecryptReader(cr.orig, cr.aead, cr.prefix, cr.size)
+	}
+	switch cr.compress {
+	case compressNone:
+		cr.r = src
+	case compressGzip:
+		gr, ok := cr.r.(*gzip.Reader)
+		if ok {
+			err = gr.Reset(src)
+		} else {
+			gr, err = gzip.NewReader(src)
+		}
+		if err != nil {
+			return err
+		}
+		cr.r = gr
+	case compressZstd:
+		if cr.zr == nil {
+			cr.zr, err = zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		} else {
+			err = cr.zr.Reset(src)
+		}
+		if err != nil {
+			return err
+		}
+		cr.r = cr.zr
+	default:
+		return fmt.Errorf("unknown compression %d", cr.compress)
+	}
+	return nil
+}
+
+// Read returns the decoded content
+func (cr *codecReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.pos += int64(n)
+	return n, err
+}
+
+// Seek moves forward by discarding content, seeking backward re-reads from the start of the blob
+func (cr *codecReader) Seek(offset int64, whence int) (int64, error) {
+	target := offset
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		target = cr.pos + offset
+	case io.SeekEnd:
+		target = cr.size + offset
+	default:
+		return cr.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if target < 0 {
+		return cr.pos, fmt.Errorf("negative position %d", target)
+	}
+	if target >= cr.size {
+		// reads at or past the end return EOF without decoding the content
+		cr.pos = target
+		cr.r = eofReader{}
+		return cr.pos, nil
+	}
+	if target < cr.pos {
+		err := cr.reset()
+		if err != nil {
+			return cr.pos, err
+		}
+	}
+	if target > cr.pos {
+		_, err := io.CopyN(io.Discard, cr, target-cr.pos)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return cr.pos, err
+		}
+	}
+	return cr.pos, nil
+}
+
+// Size returns the logical size of the blob
+func (cr *codecReader) Size() int64 {
+	return cr.size
+}
+
+// Close releases the decoder and closes the underlying reader
+func (cr *codecReader) Close() error {
+	if cr.zr != nil {
+		cr.zr.Close()
+	}
+	if c, ok := cr.orig.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
+)
+
+func TestCodec(t *testing.T) {
+	content := bytes.Repeat([]byte("compressible blob content "), 1000)
+	tests := []struct {
+		compression string
+	}{
+		{compression: ""},
+		{compression: "gzip"},
+		{compression: "zstd"},
+	}
+	var plainRoot string
+	for _, tt := range tests {
+		t.Run("compression-"+tt.compression, func(t *testing.T) {
+			cd, err := newCodec(config.Storage{Compression: tt.compression})
+			if err != nil {
+				t.Errorf("failed to create codec: %v", err)
+				return
+			}
+			s := newMemory(cd)
+			_, root, err := s.RootCreate()
+			if err != nil {
+				t.Errorf("failed to create root: %v", err)
+				return
+			}
+			bw, err := root.Write([]string{"blob"})
+			if err != nil {
+				t.Errorf("failed to create blob: %v", err)
+				return
+			}
+			_, err = bw.Write(content)
+			if err != nil {
+				t.Errorf("failed to write blob: %v", err)
+				return
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Errorf("failed to close blob: %v", err)
+				return
+			}
+			hash, err := bw.Hash()
+			if err != nil {
+				t.Errorf("failed to get hash: %v", err)
+				return
+			}
+			stored := s.blobs[hash].data
+			if tt.compression != "" && len(stored) >= len(content) {
+				t.Errorf("blob was not compressed, stored %d bytes for %d bytes of content", len(stored), len(content))
+			}
+			rootHash, err := s.RootSave(root)
+			if err != nil {
+				t.Errorf("failed to save root: %v", err)
+				return
+			}
+			if plainRoot == "" {
+				plainRoot = rootHash
+			} else if rootHash != plainRoot {
+				t.Errorf("root hash changed with compression, expected %s, received %s", plainRoot, rootHash)
+			}
+
+			br, err := s.BlobOpen(hash)
+			if err != nil {
+				t.Errorf("failed to open blob: %v", err)
+				return
+			}
+			defer br.Close()
+			if br.Size() != int64(len(content)) {
+				t.Errorf("size mismatch, expected %d, received %d", len(content), br.Size())
+			}
+			// seek to the end, back to the middle, and forward
+			end, err := br.Seek(0, io.SeekEnd)
+			if err != nil || end != int64(len(content)) {
+				t.Errorf("seek to end failed, position %d: %v", end, err)
+				return
+			}
+			for _, pos := range []int64{100, 13000, 5} {
+				_, err = br.Seek(pos, io.SeekStart)
+				if err != nil {
+					t.Errorf("seek to %d failed: %v", pos, err)
+					return
+				}
+				b := make([]byte, 50)
+				_, err = io.ReadFull(br, b)
+				if err != nil {
+					t.Errorf("read at %d failed: %v", pos, err)
+					return
+				}
+				if !bytes.Equal(b, content[pos:pos+50]) {
+					t.Errorf("read at %d mismatch, expected %s, received %s", pos, content[pos:pos+50], b)
+				}
+			}
+			_, err = br.Seek(0, io.SeekStart)
+			if err != nil {
+				t.Errorf("seek to start failed: %v", err)
+				return
+			}
+			b, err := io.ReadAll(br)
+			if err != nil {
+				t.Errorf("failed to read blob: %v", err)
+				return
+			}
+			if !bytes.Equal(b, content) {
+				t.Errorf("blob content mismatch")
+			}
+		})
+	}
+
+	t.Run("RawMagic", func(t *testing.T) {
+		// raw blobs that begin with the codec header are read unchanged
+		raws := [][]byte{
+			append(append([]byte{}, codecMagic...), []byte("\x00 content after the magic bytes")...),
+			append(append([]byte{}, codecMagic...), []byte("\x80 content after the magic bytes")...),
+			append(append([]byte{}, codecMagic...), []byte("\x01")...),
+		}
+		dirFS := t.TempDir()
+		dirBolt := t.TempDir()
+		fsRaw, err := NewFilesystem(dirFS)
+		if err != nil {
+			t.Errorf("failed to create filesystem storage: %v", err)
+			return
+		}
+		boltRaw, err := NewBolt(dirBolt)
+		if err != nil {
+			t.Errorf("failed to create bolt storage: %v", err)
+			return
+		}
+		memRaw, err := NewMemory()
+		if err != nil {
+			t.Errorf("failed to create memory storage: %v", err)
+			return
+		}
+		hashes := []string{}
+		for _, s := range []Storage{fsRaw, boltRaw, memRaw} {
+			for _, raw := range raws {
+				bw, err := s.BlobCreate()
+				if err != nil {
+					t.Errorf("failed to create blob: %v", err)
+					return
+				}
+				_, err = bw.Write(raw)
+				bw.Close()
+				if err != nil {
+					t.Errorf("failed to write blob: %v", err)
+					return
+				}
+				hash, err := bw.Hash()
+				if err != nil {
+					t.Errorf("failed to get hash: %v", err)
+					return
+				}
+				if s == fsRaw {
+					hashes = append(hashes, hash)
+				}
+				codecTestRead(t, s, hash, raw)
+			}
+		}
+		err = boltRaw.(*BoltStorage).Close()
+		if err != nil {
+			t.Errorf("failed to close bolt storage: %v", err)
+		}
+		// enabling compression later does not change how existing raw blobs are read
+		cd, err := newCodec(config.Storage{Compression: "gzip"})
+		if err != nil {
+			t.Errorf("failed to create codec: %v", err)
+			return
+		}
+		fsGzip, err := newFilesystem(dirFS, cd, "", true)
+		if err != nil {
+			t.Errorf("failed to create filesystem storage: %v", err)
+			return
+		}
+		for i, hash := range hashes {
+			codecTestRead(t, fsGzip, hash, raws[i])
+		}
+	})
+
+	t.Run("HashOnly", func(t *testing.T) {
+		// selecting a hash algorithm alone must not change the blob format
+		cd, err := newCodec(config.Storage{Hash: hasher.BLAKE3})
+		if err != nil {
+			t.Errorf("failed to create codec: %v", err)
+			return
+		}
+		if cd != nil {
+			t.Errorf("codec enabled with only the hash set")
+		}
+		dir := t.TempDir()
+		s, err := Get(config.Config{Storage: config.Storage{Kind: "filesystem", Directory: dir, Hash: hasher.BLAKE3}})
+		if err != nil {
+			t.Errorf("failed to create filesystem storage: %v", err)
+			return
+		}
+		bw, err := s.BlobCreate()
+		if err != nil {
+			t.Errorf("failed to create blob: %v", err)
+			return
+		}
+		_, err = bw.Write(content)
+		if err != nil {
+			t.Errorf("failed to write blob: %v", err)
+		}
+		err = bw.Close()
+		if err != nil {
+			t.Errorf("failed to close blob: %v", err)
+			return
+		}
+		hash, err := bw.Hash()
+		if err != nil {
+			t.Errorf("failed to get hash: %v", err)
+			return
+		}
+		if !strings.HasPrefix(hash, hasher.BLAKE3+":") {
+			t.Errorf("blob hash %s does not use %s", hash, hasher.BLAKE3)
+		}
+		blobPath, err := fsBlobPath(hash)
+		if err != nil {
+			t.Errorf("failed to get blob path: %v", err)
+			return
+		}
+		b, err := os.ReadFile(filepath.Join(dir, blobPath))
+		if err != nil {
+			t.Errorf("raw blob missing: %v", err)
+			return
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("blob written with a codec header")
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, err := newCodec(config.Storage{Compression: "lzma"})
+		if err == nil {
+			t.Errorf("unknown compression unexpectedly succeeded")
+		}
+	})
+}
+
+func codecTestRead(t *testing.T, s Storage, hash string, expect []byte) {
+	t.Helper()
+	br, err := s.BlobOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open blob %s: %v", hash, err)
+		return
+	}
+	defer br.Close()
+	b, err := io.ReadAll(br)
+	if err != nil {
+		t.Errorf("failed to read blob %s: %v", hash, err)
+		return
+	}
+	if !bytes.Equal(b, expect) || br.Size() != int64(len(expect)) {
+		t.Errorf("blob mismatch, expected %q, received %q, size %d", expect, b, br.Size())
+	}
+}
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/httplock/httplock/internal/config"
+)
+
+// Encrypted blobs follow the codec header with:
+// key id length (1 byte), key id, nonce prefix (8 bytes)
+// the content is split into chunks, each sealed with AES-GCM using the nonce prefix and a chunk counter
+// the final chunk also authenticates the logical size so truncated blobs are rejected
+
+const (
+	encryptChunkSize   = 64 * 1024
+	encryptNoncePrefix = 8
+)
+
+var errDecrypt = errors.New("failed to decrypt blob")
+
+// encryptKeys holds the configured keys by id, new blobs use the first key
+type encryptKeys struct {
+	id    string
+	aeads map[string]cipher.AEAD
+}
+
+func newEncryptKeys(c config.Encryption) (*encryptKeys, error) {
+	if len(c.Keys) == 0 {
+		return nil, nil
+	}
+	ek := encryptKeys{
+		id:    c.Keys[0].ID,
+		aeads: map[string]cipher.AEAD{},
+	}
+	for _, k := range c.Keys {
+		if len(k.ID) > math.MaxUint8 {
+			return nil, fmt.Errorf("encryption key id %q is too long", k.ID)
+		}
+		if _, ok := ek.aeads[k.ID]; ok {
+			return nil, fmt.Errorf("encryption key id %q is duplicated", k.ID)
+		}
+		keyEnc := k.Key
+		if k.File != "" {
+			if keyEnc != "" {
+				return nil, fmt.Errorf("encryption key %q has both a key and file", k.ID)
+			}
+			b, err := os.ReadFile(k.File)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read encryption key %q: %w", k.ID, err)
+			}
+			keyEnc = strings.TrimSpace(string(b))
+		}
+		key, err := base64.StdEncoding.DecodeString(keyEnc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encryption key %q: %w", k.ID, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %q: %w", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ek.aeads[k.ID] = aead
+	}
+	return &ek, nil
+}
+
+// encryptAD returns the additional data authenticated with each chunk
+func encryptAD(final bool, size int64) []byte {
+	if !final {
+		return []byte{0}
+	}
+	ad := make([]byte, 9)
+	ad[0] = 1
+	binary.BigEndian.PutUint64(ad[1:], uint64(size))
+	return ad
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	count uint32
+	buf   []byte
+	out   []byte
+}
+
+// newEncryptWriter writes the encryption header and returns a writer that seals content in chunks
+func newEncryptWriter(w io.Writer, ek *encryptKeys) (*encryptWriter, error) {
+	aead := ek.aeads[ek.id]
+	header := make([]byte, 1, 1+len(ek.id)+encryptNoncePrefix)
+	header[0] = byte(len(ek.id))
+	header = append(header, ek.id...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce[:encryptNoncePrefix])
+	if err != nil {
+		return nil, err
+	}
+	header = append(header, nonce[:encryptNoncePrefix]...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:     w,
+		aead:  aead,
+		nonce: nonce,
+	}, nil
+}
+
+// Write buffers content, chunks are sealed once it is known they are not the final chunk
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	ew.buf = append(ew.buf, p...)
+	for len(ew.buf) > encryptChunkSize {
+		err := ew.seal(ew.buf[:encryptChunkSize], encryptAD(false, 0))
+		if err != nil {
+			return 0, err
+		}
+		ew.buf = append(ew.buf[:0], ew.buf[encryptChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// finish seals the remaining content as the final chunk
+func (ew *encryptWriter) finish(size int64) error {
+	return ew.seal(ew.buf, encryptAD(true, size))
+}
+
+func (ew *encryptWriter) seal(chunk, ad []byte) error {
+	if ew.count == math.MaxUint32 {
+		return fmt.Errorf("blob exceeds the maximum encrypted size")
+	}
+	binary.BigEndian.PutUint32(ew.nonce[encryptNoncePrefix:], ew.count)
+	ew.count++
+	ew.out = ew.aead.Seal(ew.out[:0], ew.nonce, chunk, ad)
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+// readEncryptHeader reads the encryption header and returns the key and nonce prefix
+func readEncryptHeader(rdr io.Reader, ek *encryptKeys) (cipher.AEAD, []byte, int64, error) {
+	idLen := make([]byte, 1)
+	_, err := io.ReadFull(rdr, idLen)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	header := make([]byte, int(idLen[0])+encryptNoncePrefix)
+	_, err = io.ReadFull(rdr, header)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	id := string(header[:idLen[0]])
+	if ek == nil {
+		return nil, nil, 0, fmt.Errorf("blob is encrypted with key %q, no keys are configured", id)
+	}
+	aead, ok := ek.aeads[id]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("blob is encrypted with unknown key %q", id)
+	}
+	return aead, header[idLen[0]:], int64(1 + len(header)), nil
+}
+
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	count uint32
+	size  int64
+	in    []byte
+	plain []byte
+	out   []byte
+	final bool
+}
+
+func newDecryptReader(r io.Reader, aead cipher.AEAD, prefix []byte, size int64) *decryptReader {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, prefix)
+	return &decryptReader{
+		r:     r,
+		aead:  aead,
+		nonce: nonce,
+		size:  size,
+		in:    make([]byte, encryptChunkSize+aead.Overhead()),
+	}
+}
+
+// Read returns the decrypted content, only authenticated chunks are returned
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.final {
+			return 0, io.EOF
+		}
+		err := dr.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) next() error {
+	n, err := io.ReadFull(dr.r, dr.in)
+	full := err == nil
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	binary.BigEndian.PutUint32(dr.nonce[encryptNoncePrefix:], dr.count)
+	dr.count++
+	// a full chunk may be the final chunk when the content is a multiple of the chunk size
+	if full {
+		dr.out, err = dr.aead.Open(dr.plain[:0], dr.nonce, dr.in[:n], encryptAD(false, 0))
+	}
+	if !full || err != nil {
+		dr.out, err = dr.aead.Open(dr.plain[:0], dr.nonce, dr.in[:n], encryptAD(true, dr.size))
+		if err != nil {
+			return fmt.Errorf("%w: chunk %d: %v", errDecrypt, dr.count-1, err)
+		}
+		dr.final = true
+	}
+	dr.plain = dr.out
+	return nil
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/httplock/httplock/internal/config"
+)
+
+func TestEncrypt(t *testing.T) {
+	keyA := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	keyB := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 16))
+	keyFile := filepath.Join(t.TempDir(), "key")
+	err := os.WriteFile(keyFile, []byte(keyB+"\n"), 0600)
+	if err != nil {
+		t.Errorf("failed to write key file: %v", err)
+		return
+	}
+	confA := config.Storage{Encryption: config.Encryption{Keys: []config.EncryptionKey{
+		{ID: "a", Key: keyA},
+	}}}
+	confRotate := config.Storage{Compression: "gzip", Encryption: config.Encryption{Keys: []config.EncryptionKey{
+		{ID: "b", File: keyFile},
+		{ID: "a", Key: keyA},
+	}}}
+	confB := config.Storage{Encryption: config.Encryption{Keys: []config.EncryptionKey{
+		{ID: "b", Key: keyB},
+	}}}
+	cdA, err := newCodec(confA)
+	if err != nil {
+		t.Errorf("failed to create codec: %v", err)
+		return
+	}
+	cdRotate, err := newCodec(confRotate)
+	if err != nil {
+		t.Errorf("failed to create codec: %v", err)
+		return
+	}
+	cdB, err := newCodec(confB)
+	if err != nil {
+		t.Errorf("failed to create codec: %v", err)
+		return
+	}
+	secret := []byte("Authorization: Bearer secret-token ")
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{name: "empty", content: []byte{}},
+		{name: "short", content: secret},
+		{name: "chunk", content: bytes.Repeat([]byte{'x'}, encryptChunkSize)},
+		{name: "multi-chunk", content: bytes.Repeat(secret, encryptChunkSize/len(secret)*3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cd := range []*codec{cdA, cdRotate} {
+				enc := encryptBlob(t, cd, tt.content)
+				if enc == nil {
+					return
+				}
+				if len(tt.content) > 0 && bytes.Contains(enc, tt.content[:minInt(len(tt.content), 32)]) {
+					t.Errorf("plaintext found in encrypted blob")
+				}
+				// the rotated config reads blobs from either key
+				b, err := decryptBlob(cdRotate, enc)
+				if err != nil {
+					t.Errorf("failed to read blob: %v", err)
+					return
+				}
+				if !bytes.Equal(b, tt.content) {
+					t.Errorf("content mismatch, expected %d bytes, received %d", len(tt.content), len(b))
+				}
+			}
+		})
+	}
+
+	t.Run("WrongKey", func(t *testing.T) {
+		enc := encryptBlob(t, cdA, secret)
+		_, err := decryptBlob(cdB, enc)
+		if err == nil {
+			t.Errorf("read with an unknown key unexpectedly succeeded")
+		}
+		_, err = decryptBlob(nil, enc)
+		if err == nil {
+			t.Errorf("read without keys unexpectedly succeeded")
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		content := bytes.Repeat(secret, encryptChunkSize/len(secret)*2)
+		enc := encryptBlob(t, cdA, content)
+		if enc == nil {
+			return
+		}
+		mod := append([]byte{}, enc...)
+		mod[len(mod)/2] ^= 1
+		_, err := decryptBlob(cdA, mod)
+		if !errors.Is(err, errDecrypt) {
+			t.Errorf("modified blob did not fail to decrypt: %v", err)
+		}
+		// drop the final chunk
+		finalLen := len(content) - encryptChunkSize + cdA.keys.aeads["a"].Overhead()
+		_, err = decryptBlob(cdA, enc[:len(enc)-finalLen])
+		if !errors.Is(err, errDecrypt) {
+			t.Errorf("truncated blob did not fail to decrypt: %v", err)
+		}
+		// change the logical size in the header
+		mod = append([]byte{}, enc...)
+		mod[codecHeaderLen-1] ^= 1
+		_, err = decryptBlob(cdA, mod)
+		if !errors.Is(err, errDecrypt) {
+			t.Errorf("blob with a modified size did not fail to decrypt: %v", err)
+		}
+	})
+
+	t.Run("InvalidKeys", func(t *testing.T) {
+		confs := []config.Encryption{
+			{Keys: []config.EncryptionKey{{ID: "short", Key: base64.StdEncoding.EncodeToString([]byte("short"))}}},
+			{Keys: []config.EncryptionKey{{ID: "encoding", Key: "not base64!"}}},
+			{Keys: []config.EncryptionKey{{ID: "dup", Key: keyA}, {ID: "dup", Key: keyB}}},
+			{Keys: []config.EncryptionKey{{ID: "both", Key: keyA, File: keyFile}}},
+			{Keys: []config.EncryptionKey{{ID: "missing", File: filepath.Join(t.TempDir(), "missing")}}},
+		}
+		for _, c := range confs {
+			_, err := newCodec(config.Storage{Encryption: c})
+			if err == nil {
+				t.Errorf("invalid key %s unexpectedly succeeded", c.Keys[0].ID)
+			}
+		}
+	})
+}
+
+func encryptBlob(t *testing.T, cd *codec, content []byte) []byte {
+	t.Helper()
+	mb := memBuffer{}
+	w, err := cd.writer(&mb)
+	if err != nil {
+		t.Errorf("failed to create writer: %v", err)
+		return nil
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		t.Errorf("failed to write: %v", err)
+		return nil
+	}
+	err = w.(io.Closer).Close()
+	if err != nil {
+		t.Errorf("failed to close: %v", err)
+		return nil
+	}
+	return mb.buf
+}
+
+func decryptBlob(cd *codec, enc []byte) ([]byte, error) {
+	br, err := cd.reader(bytes.NewReader(enc), int64(len(enc)), true)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	return io.ReadAll(br)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
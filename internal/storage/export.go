@@ -31,10 +31,14 @@ func Export(s Storage, id string, w io.Writer) error {
 		return err
 	}
 
-	// add index.json with root array entry
+	// add index.json with root array entry, including the user metadata
+	ir := IndexRoot{}
+	if src, ok := s.Index().Roots[id]; ok && src != nil {
+		ir.RootInfo = src.RootInfo
+	}
 	ind := Index{
 		Roots: map[string]*IndexRoot{
-			root.hash: {},
+			root.hash: &ir,
 		},
 	}
 	ij, err := json.Marshal(ind)
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
+)
+
+func TestExportImport(t *testing.T) {
+	content := []byte("hello world")
+	sha256Storage, err := NewMemory()
+	if err != nil {
+		t.Errorf("failed to create memory storage: %v", err)
+		return
+	}
+	blake3Storage, err := Get(config.Config{Storage: config.Storage{Kind: "filesystem", Directory: t.TempDir(), Hash: hasher.BLAKE3, Verify: true}})
+	if err != nil {
+		t.Errorf("failed to create filesystem storage: %v", err)
+		return
+	}
+	_, err = Get(config.Config{Storage: config.Storage{Kind: "filesystem", Directory: t.TempDir(), Hash: "md5"}})
+	if err == nil {
+		t.Errorf("storage with md5 unexpectedly succeeded")
+	}
+	_, err = blake3Storage.BlobCreate(WithAlgorithm("md5"))
+	if err == nil {
+		t.Errorf("blob create with md5 unexpectedly succeeded")
+	}
+
+	tests := []struct {
+		name   string
+		src    Storage
+		dst    Storage
+		srcAlg string
+	}{
+		{
+			name:   "sha256 to blake3",
+			src:    sha256Storage,
+			dst:    blake3Storage,
+			srcAlg: hasher.SHA256,
+		},
+		{
+			name:   "blake3 to sha256",
+			src:    blake3Storage,
+			dst:    sha256Storage,
+			srcAlg: hasher.BLAKE3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, root, err := tt.src.RootCreate()
+			if err != nil {
+				t.Errorf("failed to create root: %v", err)
+				return
+			}
+			bw, err := root.Write([]string{tt.name, "file"})
+			if err != nil {
+				t.Errorf("failed to write: %v", err)
+				return
+			}
+			_, err = bw.Write(content)
+			if err != nil {
+				t.Errorf("failed to write: %v", err)
+			}
+			bw.Close()
+			info := RootInfo{
+				Labels:      map[string]string{"project": "httplock"},
+				Description: tt.name,
+				Creator:     "test",
+			}
+			root.SetInfo(info)
+			id, err := tt.src.RootSave(root)
+			if err != nil {
+				t.Errorf("failed to save root: %v", err)
+				return
+			}
+			if !strings.HasPrefix(id, tt.srcAlg+":") {
+				t.Errorf("root hash %s does not use %s", id, tt.srcAlg)
+			}
+			buf := bytes.Buffer{}
+			err = Export(tt.src, id, &buf)
+			if err != nil {
+				t.Errorf("failed to export: %v", err)
+				return
+			}
+			// the imported root keeps the hash and algorithm of the source
+			err = Import(tt.dst, id, &buf)
+			if err != nil {
+				t.Errorf("failed to import: %v", err)
+				return
+			}
+			// the user metadata is included in the export
+			if ir, ok := tt.dst.Index().Roots[id]; !ok {
+				t.Errorf("imported root %s missing from index", id)
+			} else if ir.Labels["project"] != info.Labels["project"] || ir.Description != info.Description || ir.Creator != info.Creator ||
+				!ir.Created.Equal(tt.src.Index().Roots[id].Created) {
+				t.Errorf("imported root info mismatch, expected %v, received %v", tt.src.Index().Roots[id].RootInfo, ir.RootInfo)
+			}
+			rootHash, err := tt.dst.RootOpen(id)
+			if err != nil {
+				t.Errorf("failed to open root: %v", err)
+				return
+			}
+			br, err := rootHash.Read([]string{tt.name, "file"})
+			if err != nil {
+				t.Errorf("failed to read: %v", err)
+				return
+			}
+			b, err := io.ReadAll(br)
+			br.Close()
+			if err != nil {
+				t.Errorf("failed to read: %v", err)
+			}
+			if !bytes.Equal(b, content) {
+				t.Errorf("content mismatch, expected %s, received %s", content, b)
+			}
+			// a root created from the hash is saved with the same algorithm
+			_, rootFrom, err := tt.dst.RootCreateFrom(id)
+			if err != nil {
+				t.Errorf("failed to create root from hash: %v", err)
+				return
+			}
+			_, err = rootFrom.List([]string{})
+			if err != nil {
+				t.Errorf("failed to list root: %v", err)
+			}
+			saved, err := tt.dst.RootSave(rootFrom)
+			if err != nil {
+				t.Errorf("failed to save root: %v", err)
+			} else if saved != id {
+				t.Errorf("unmodified root saved as %s, expected %s", saved, id)
+			}
+			// saving the same hash again keeps the existing metadata
+			if ir := tt.dst.Index().Roots[id]; ir == nil || ir.Labels["project"] != info.Labels["project"] || ir.Description != info.Description {
+				t.Errorf("root info lost after saving the same hash")
+			}
+			report, err := Check(tt.dst, CheckOpts{})
+			if err != nil {
+				t.Errorf("failed to check: %v", err)
+			} else if len(report.Problems) > 0 {
+				t.Errorf("check found problems: %v", report.Problems)
+			}
+		})
+	}
+}
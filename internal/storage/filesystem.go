@@ -8,6 +8,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,22 +18,42 @@ import (
 
 // Filesystem storage is backed by a directory
 
-const fsTmpDir = "tmp"
+const (
+	fsTmpDir        = "tmp"
+	fsBlobDir       = "blobs"
+	fsQuarantineDir = "quarantine"
+	fsCodecExt      = ".hlb" // appended to the path of blobs written with a codec
+)
 
 func init() {
 	Register("filesystem", func(c config.Config) (Storage, error) {
-		return NewFilesystem(c.Storage.Directory)
+		cd, err := newCodec(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		algo, err := newAlgorithm(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		return newFilesystem(c.Storage.Directory, cd, algo, c.Storage.Verify)
 	})
 }
 
 type FSStorage struct {
-	mu    sync.Mutex
-	dir   string
-	index Index
-	roots map[string]*Root
+	mu     sync.Mutex
+	dir    string
+	index  Index
+	roots  map[string]*Root
+	cd     *codec
+	algo   string // hash algorithm of new blobs, empty for the default
+	verify bool   // rehash blobs as they are read
 }
 
 func NewFilesystem(dir string) (Storage, error) {
+	return newFilesystem(dir, nil, "", false)
+}
+
+func newFilesystem(dir string, cd *codec, algo string, verify bool) (Storage, error) {
 	fi, err := os.Stat(filepath.Join(dir, fsTmpDir))
 	if err != nil {
 		// create the directory if it doesn't exist
@@ -47,12 +68,66 @@ func NewFilesystem(dir string) (Storage, error) {
 	} else if !fi.IsDir() {
 		return nil, fmt.Errorf("%s exists and is not a directory%.0w", dir, fs.ErrExist)
 	}
+	err = fsMigrateFlat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate blobs: %w", err)
+	}
 	return &FSStorage{
-		dir:   dir,
-		index: readIndex(dir),
-		roots: map[string]*Root{},
+		dir:    dir,
+		index:  readIndex(dir),
+		roots:  map[string]*Root{},
+		cd:     cd,
+		algo:   algo,
+		verify: verify,
 	}, nil
 }
+
+// fsBlobPath returns the sharded path of a blob relative to the storage directory, e.g. blobs/sha256/ab/abcd...
+func fsBlobPath(hash string) (string, error) {
+	algo, hex, ok := strings.Cut(hash, ":")
+	if !ok || algo == "" || len(hex) < 2 {
+		return "", fmt.Errorf("invalid hash %q", hash)
+	}
+	for _, c := range algo {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') {
+			return "", fmt.Errorf("invalid hash algorithm %q", hash)
+		}
+	}
+	for _, c := range hex {
+		if !(c >= 'a' && c <= 'f') && !(c >= '0' && c <= '9') {
+			return "", fmt.Errorf("invalid hash encoding %q", hash)
+		}
+	}
+	return filepath.Join(fsBlobDir, algo, hex[:2], hex), nil
+}
+
+// fsMigrateFlat moves blobs from the flat layout of older releases into the sharded layout
+func fsMigrateFlat(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		blobPath, err := fsBlobPath(entry.Name())
+		if err != nil {
+			// not a blob, e.g. the index
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, blobPath)), 0777)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(dir, blobPath))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func readIndex(dir string) Index {
 	ind := Index{
 		Roots: map[string]*IndexRoot{},
@@ -73,31 +148,41 @@ func readIndex(dir string) Index {
 
 // BlobOpen returns a reader for a blob
 func (fs *FSStorage) BlobOpen(blob string) (BlobReader, error) {
-	fh, err := os.OpenFile(filepath.Join(fs.dir, blob), os.O_RDONLY, 0666)
-	if err != nil {
-		return nil, err
+	br, err := fsBlobOpen(fs.dir, blob, fs.cd)
+	if err != nil || !fs.verify {
+		return br, err
 	}
-	stat, err := fh.Stat()
+	vr, err := newVerifyReader(br, blob)
 	if err != nil {
+		br.Close()
 		return nil, err
 	}
-	return newBlobReader(fh, stat.Size())
+	return vr, nil
 }
 
 // BlobCreate returns a writer for a blob
-func (fs *FSStorage) BlobCreate() (BlobWriter, error) {
+func (fs *FSStorage) BlobCreate(opts ...BlobOpt) (BlobWriter, error) {
+	algo, err := blobAlgorithm(fs.algo, opts)
+	if err != nil {
+		return nil, err
+	}
 	fh, err := os.CreateTemp(filepath.Join(fs.dir, fsTmpDir), "*")
 	if err != nil {
 		return nil, err
 	}
-	return newBlobWriter(fh, func(hash string) error {
-		err := os.Rename(fh.Name(), filepath.Join(fs.dir, hash))
-		if err != nil {
-			os.Remove(fh.Name())
-			return err
-		}
-		return nil
-	}), nil
+	w, err := fs.cd.writer(fh)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	bw, err := newBlobWriter(w, algo, func(hash string) error {
+		return fsRename(fh.Name(), fs.dir, hash, fs.cd != nil)
+	})
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return bw, nil
 }
 
 // Flush writes any data cached to the backend storage
@@ -113,12 +198,12 @@ func (fs *FSStorage) Index() Index {
 
 // PruneCache deletes any data from memory or cache that hasn't been recently accessed
 func (fs *FSStorage) PruneCache(time.Duration) error {
-	return errNotImplemented
+	return ErrNotImplemented
 }
 
 // PruneStorage deletes any blobs that are not used by any root
 func (fs *FSStorage) PruneStorage() error {
-	return errNotImplemented
+	return ErrNotImplemented
 }
 
 // RootCreate returns a new root using a uuid
@@ -141,39 +226,55 @@ func (fs *FSStorage) RootCreateFrom(hash string) (string, *Root, error) {
 	}
 	root := newRootHash(fs, hash)
 	root.readonly = false
+	root.metaHash = fs.index.Roots[hash].Meta
 	fs.roots[u] = root
 	return u, root, nil
 }
 
 // RootOpen returns an existing root
 func (fs *FSStorage) RootOpen(name string) (*Root, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 	if root, ok := fs.roots[name]; ok {
 		return root, nil
 	}
 	if _, ok := fs.index.Roots[name]; !ok {
 		return nil, fmt.Errorf("hash not found in index: %s", name)
 	}
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
 	fs.index.Roots[name].Used = time.Now() // TODO: consider moving up
 	root := newRootHash(fs, name)
+	root.metaHash = fs.index.Roots[name].Meta
 	fs.roots[name] = root
 	return root, nil
 }
 
+// rootUsed updates the last used time of a root in the index
+func (fs *FSStorage) rootUsed(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if ir, ok := fs.index.Roots[name]; ok {
+		ir.Used = time.Now()
+	}
+}
+
 // RootSave saves a root and adds the hash to the index
 func (fs *FSStorage) RootSave(r *Root) (string, error) {
 	hash, err := r.Save()
 	if err != nil {
 		return "", err
 	}
+	metaHash, err := r.saveMeta()
+	if err != nil {
+		return "", err
+	}
+	ir := r.indexRoot(metaHash)
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	newRoot := newRootHash(fs, hash)
+	newRoot.metaHash = metaHash
 	fs.roots[hash] = newRoot
-	fs.index.Roots[hash] = &IndexRoot{
-		Used: time.Now(),
-	}
+	ir.merge(fs.index.Roots[hash])
+	fs.index.Roots[hash] = &ir
 	err = fs.writeIndex()
 	if err != nil {
 		return "", err
@@ -181,6 +282,171 @@ func (fs *FSStorage) RootSave(r *Root) (string, error) {
 	return hash, nil
 }
 
+// blobList returns the hash of every blob
+func (fs *FSStorage) blobList() ([]string, error) {
+	return fsBlobList(fs.dir)
+}
+
+// blobDelete removes a blob
+func (fs *FSStorage) blobDelete(hash string) error {
+	return fsBlobRemove(fs.dir, hash)
+}
+
+// blobSize returns the size of a blob
+func (fs *FSStorage) blobSize(hash string) (int64, error) {
+	return fsBlobSize(fs.dir, hash)
+}
+
+// blobQuarantine moves a blob into the quarantine directory
+func (fs *FSStorage) blobQuarantine(hash string) error {
+	return fsQuarantine(fs.dir, hash)
+}
+
+// fsBlobOpen opens a blob from the sharded path, the codec is only used for blobs stored with the codec extension
+func fsBlobOpen(dir, hash string, cd *codec) (BlobReader, error) {
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	encoded := true
+	fh, err := os.Open(filepath.Join(dir, blobPath+fsCodecExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		encoded = false
+		fh, err = os.Open(filepath.Join(dir, blobPath))
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	br, err := cd.reader(fh, stat.Size(), encoded)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return br, nil
+}
+
+// fsBlobSize returns the size of a blob from the file size, or the header of blobs stored with the codec extension
+func fsBlobSize(dir, hash string) (int64, error) {
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return 0, err
+	}
+	fh, err := os.Open(filepath.Join(dir, blobPath+fsCodecExt))
+	if errors.Is(err, fs.ErrNotExist) {
+		fi, err := os.Stat(filepath.Join(dir, blobPath))
+		if err != nil {
+			return 0, err
+		}
+		return fi.Size(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	return codecSize(fh)
+}
+
+// fsBlobRemove deletes both the raw and encoded copies of a blob
+func fsBlobRemove(dir, hash string) error {
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return err
+	}
+	errRaw := os.Remove(filepath.Join(dir, blobPath))
+	errEnc := os.Remove(filepath.Join(dir, blobPath+fsCodecExt))
+	for _, err := range []error{errRaw, errEnc} {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if errRaw != nil && errEnc != nil {
+		// neither copy exists
+		return errRaw
+	}
+	return nil
+}
+
+// fsQuarantine moves a blob from the sharded path to the quarantine directory, e.g. quarantine/sha256/abcd...
+func fsQuarantine(dir, hash string) error {
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return err
+	}
+	qDir := filepath.Join(dir, fsQuarantineDir, filepath.Base(filepath.Dir(filepath.Dir(blobPath))))
+	err = os.MkdirAll(qDir, 0777)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, ext := range []string{"", fsCodecExt} {
+		err = os.Rename(filepath.Join(dir, blobPath+ext), filepath.Join(qDir, filepath.Base(blobPath)+ext))
+		if err == nil {
+			found = true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if !found {
+		return fmt.Errorf("blob %s not found%.0w", hash, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// fsBlobList walks the sharded blob directories returning the hash of each blob
+func fsBlobList(dir string) ([]string, error) {
+	hashes := []string{}
+	seen := map[string]bool{}
+	root := filepath.Join(dir, fsBlobDir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// blobs/<algo>/<prefix>/<hex>[.hlb]
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) != 3 {
+			return nil
+		}
+		hash := parts[0] + ":" + strings.TrimSuffix(parts[2], fsCodecExt)
+		if !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// fsRename moves a temp file into the sharded path of the blob, encoded blobs use the codec extension
+func fsRename(tmpName, dir, hash string, encoded bool) error {
+	blobPath, err := fsBlobPath(hash)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(dir, blobPath)), 0777)
+	}
+	if err == nil {
+		if encoded {
+			blobPath += fsCodecExt
+		}
+		err = os.Rename(tmpName, filepath.Join(dir, blobPath))
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
 func (fs *FSStorage) writeIndex() error {
 	indBytes, err := json.Marshal(fs.index)
 	if err != nil {
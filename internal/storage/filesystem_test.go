@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/httplock/httplock/hasher"
+)
+
+func TestFSBlobPath(t *testing.T) {
+	tests := []struct {
+		hash      string
+		expect    string
+		expectErr bool
+	}{
+		{
+			hash:   "sha256:abcdef0123",
+			expect: filepath.Join("blobs", "sha256", "ab", "abcdef0123"),
+		},
+		{hash: "abcdef0123", expectErr: true},
+		{hash: ":abcdef0123", expectErr: true},
+		{hash: "sha256:a", expectErr: true},
+		{hash: "sha256:ABCDEF", expectErr: true},
+		{hash: "sha256:../../etc/passwd", expectErr: true},
+		{hash: "../sha256:abcdef", expectErr: true},
+		{hash: "index.json", expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hash, func(t *testing.T) {
+			result, err := fsBlobPath(tt.hash)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("invalid hash accepted, returned %s", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if result != tt.expect {
+				t.Errorf("unexpected path, expected %s, received %s", tt.expect, result)
+			}
+		})
+	}
+}
+
+func TestFSMigrate(t *testing.T) {
+	dir := t.TempDir()
+	blob := []byte("blob in the flat layout")
+	hash, err := hasher.FromBytes(blob)
+	if err != nil {
+		t.Errorf("failed to hash blob: %v", err)
+		return
+	}
+	// setup the flat layout with an index
+	err = os.WriteFile(filepath.Join(dir, hash), blob, 0666)
+	if err != nil {
+		t.Errorf("failed to write blob: %v", err)
+		return
+	}
+	err = os.WriteFile(filepath.Join(dir, filenameIndexJSON), []byte(`{"roots":{}}`), 0666)
+	if err != nil {
+		t.Errorf("failed to write index: %v", err)
+		return
+	}
+	s, err := NewFilesystem(dir)
+	if err != nil {
+		t.Errorf("failed to open storage: %v", err)
+		return
+	}
+	br, err := s.BlobOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open migrated blob: %v", err)
+		return
+	}
+	b, err := io.ReadAll(br)
+	br.Close()
+	if err != nil {
+		t.Errorf("failed to read blob: %v", err)
+		return
+	}
+	if !bytes.Equal(b, blob) {
+		t.Errorf("blob content mismatch")
+	}
+	if _, err := os.Stat(filepath.Join(dir, hash)); err == nil {
+		t.Errorf("flat blob was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, filenameIndexJSON)); err != nil {
+		t.Errorf("index was moved: %v", err)
+	}
+}
+
+func TestFSVerify(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFilesystem(dir, nil, "", true)
+	if err != nil {
+		t.Errorf("failed to open storage: %v", err)
+		return
+	}
+	blob := bytes.Repeat([]byte("verified content "), 100)
+	bw, err := s.BlobCreate()
+	if err != nil {
+		t.Errorf("failed to create blob: %v", err)
+		return
+	}
+	_, err = bw.Write(blob)
+	if err != nil {
+		t.Errorf("failed to write blob: %v", err)
+		return
+	}
+	bw.Close()
+	hash, err := bw.Hash()
+	if err != nil {
+		t.Errorf("failed to get hash: %v", err)
+		return
+	}
+	br, err := s.BlobOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open blob: %v", err)
+		return
+	}
+	// a partial read followed by a seek to the start is still verified
+	_, err = io.ReadFull(br, make([]byte, 100))
+	if err != nil {
+		t.Errorf("failed to read blob: %v", err)
+		return
+	}
+	_, err = br.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Errorf("failed to seek: %v", err)
+		return
+	}
+	_, err = io.ReadAll(br)
+	br.Close()
+	if err != nil {
+		t.Errorf("failed to read unmodified blob: %v", err)
+	}
+	// a range read of an unmodified blob returns the content after the seek
+	br, err = s.BlobOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open blob: %v", err)
+		return
+	}
+	_, err = br.Seek(100, io.SeekStart)
+	if err != nil {
+		t.Errorf("failed to seek: %v", err)
+		br.Close()
+		return
+	}
+	b, err := io.ReadAll(br)
+	br.Close()
+	if err != nil || !bytes.Equal(b, blob[100:]) {
+		t.Errorf("range read of unmodified blob failed: %v", err)
+	}
+
+	// modify the blob on disk
+	blobPath, _ := fsBlobPath(hash)
+	modified := append([]byte{}, blob...)
+	modified[50] = 'X'
+	err = os.WriteFile(filepath.Join(dir, blobPath), modified, 0666)
+	if err != nil {
+		t.Errorf("failed to modify blob: %v", err)
+		return
+	}
+	br, err = s.BlobOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open blob: %v", err)
+		return
+	}
+	_, err = io.ReadAll(br)
+	br.Close()
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("read of modified blob did not fail with a hash mismatch: %v", err)
+	}
+	// the full blob is verified before a range read
+	br, err = s.BlobOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open blob: %v", err)
+		return
+	}
+	_, err = br.Seek(100, io.SeekStart)
+	br.Close()
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Errorf("seek in modified blob did not fail with a hash mismatch: %v", err)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+
+	"github.com/httplock/httplock/hasher"
 )
 
 func Import(s Storage, id string, r io.Reader) error {
@@ -94,16 +96,23 @@ func Import(s Storage, id string, r io.Reader) error {
 		return err
 	}
 
+	algo, err := hasher.Algorithm(id)
+	if err != nil {
+		return err
+	}
 	// recursively import the referenced blobs, and add the root
 	dir, err := importDir(s, id, tmpDir)
 	if err != nil {
 		return err
 	}
-	newRoot := &Root{
-		storage: s,
-		dir:     dir,
+	// the root is saved with the algorithm and user metadata of the imported root
+	impRoot := newRoot(s)
+	impRoot.dir = dir
+	impRoot.algo = algo
+	if ir := ind.Roots[id]; ir != nil {
+		impRoot.info = ir.RootInfo
 	}
-	hash, err := s.RootSave(newRoot)
+	hash, err := s.RootSave(impRoot)
 	if err != nil {
 		return err
 	}
@@ -132,8 +141,12 @@ func importDir(s Storage, hash string, tmpDir string) (*Dir, error) {
 	if err != nil {
 		return nil, err
 	}
-	// push to storage
-	bw, err := s.BlobCreate()
+	// push to storage, keeping the algorithm of the exported blob
+	algo, err := hasher.Algorithm(hash)
+	if err != nil {
+		return nil, err
+	}
+	bw, err := s.BlobCreate(WithAlgorithm(algo))
 	if err != nil {
 		return nil, err
 	}
@@ -185,8 +198,12 @@ func importFile(s Storage, hash string, tmpDir string) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
-	// push to storage
-	bw, err := s.BlobCreate()
+	// push to storage, keeping the algorithm of the exported blob
+	algo, err := hasher.Algorithm(hash)
+	if err != nil {
+		return nil, err
+	}
+	bw, err := s.BlobCreate(WithAlgorithm(algo))
 	if err != nil {
 		return nil, err
 	}
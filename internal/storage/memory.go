@@ -2,8 +2,14 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,65 +21,233 @@ import (
 
 func init() {
 	Register("memory", func(c config.Config) (Storage, error) {
-		return NewMemory()
+		cd, err := newCodec(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		algo, err := newAlgorithm(c.Storage)
+		if err != nil {
+			return nil, err
+		}
+		m := newMemory(cd)
+		m.algo = algo
+		m.limit = c.Storage.MemoryLimit
+		m.dir = c.Storage.Directory
+		return m, nil
 	})
 }
 
 type MemStorage struct {
-	mu    sync.Mutex
-	index Index
-	roots map[string]*Root
-	blobs map[string][]byte
+	mu       sync.Mutex
+	index    Index
+	roots    map[string]*Root
+	blobs    map[string]*memBlob
+	cd       *codec
+	algo     string // hash algorithm of new blobs, empty for the default
+	limit    int64  // maximum bytes of blobs held in memory, 0 for no limit
+	size     int64  // bytes of blobs held in memory
+	dir      string // directory for blobs evicted from memory, a temp dir is created when empty
+	tmpDir   bool   // dir was created by spillDir and is removed on close
+	evict    sync.WaitGroup
+	evictErr error
+	evicting bool
+}
+
+// memBlob is held in memory until it is evicted and spilled to disk
+type memBlob struct {
+	data    []byte
+	encoded bool // written with the codec
+	spilled bool
+	access  time.Time
 }
 
 func NewMemory() (Storage, error) {
+	return newMemory(nil), nil
+}
+
+func newMemory(cd *codec) *MemStorage {
 	return &MemStorage{
 		index: Index{
 			Roots: map[string]*IndexRoot{},
 		},
 		roots: map[string]*Root{},
-		blobs: map[string][]byte{},
-	}, nil
+		blobs: map[string]*memBlob{},
+		cd:    cd,
+	}
 }
 
 // BlobOpen returns a reader for a blob
 func (m *MemStorage) BlobOpen(blob string) (BlobReader, error) {
-	if bb, ok := m.blobs[blob]; ok {
-		br := bytes.NewReader(bb)
-		return newBlobReader(br, int64(len(bb)))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mb, ok := m.blobs[blob]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	mb.access = time.Now()
+	if !mb.spilled {
+		return m.cd.reader(bytes.NewReader(mb.data), int64(len(mb.data)), mb.encoded)
+	}
+	fh, err := m.spillOpen(blob)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	br, err := m.cd.reader(fh, stat.Size(), mb.encoded)
+	if err != nil {
+		fh.Close()
+		return nil, err
 	}
-	return nil, fs.ErrNotExist
+	return br, nil
 }
 
 // BlobCreate returns a writer for a blob
-func (m *MemStorage) BlobCreate() (BlobWriter, error) {
-	b := bytes.Buffer{}
-	bw := newBlobWriter(&b, func(hash string) error {
-		m.blobs[hash] = b.Bytes()
+func (m *MemStorage) BlobCreate(opts ...BlobOpt) (BlobWriter, error) {
+	algo, err := blobAlgorithm(m.algo, opts)
+	if err != nil {
+		return nil, err
+	}
+	b := memBuffer{}
+	w, err := m.cd.writer(&b)
+	if err != nil {
+		return nil, err
+	}
+	bw, err := newBlobWriter(w, algo, func(hash string) error {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if mb, ok := m.blobs[hash]; ok {
+			mb.access = time.Now()
+			return nil
+		}
+		m.blobs[hash] = &memBlob{
+			data:    b.buf,
+			encoded: m.cd != nil,
+			access:  time.Now(),
+		}
+		m.size += int64(len(b.buf))
+		if m.limit > 0 && m.size > m.limit && !m.evicting {
+			// eviction runs in the background to avoid blocking the writer
+			m.evicting = true
+			m.evict.Add(1)
+			go m.evictLimit()
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	return bw, nil
 }
 
-// Flush writes any data cached to the backend storage
-func (m *MemStorage) Flush() error {
-	// noop, all data is in memory, never written to disk
+// blobList returns the hash of every blob
+func (m *MemStorage) blobList() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hashes := make([]string, 0, len(m.blobs))
+	for hash := range m.blobs {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// blobDelete removes a blob
+func (m *MemStorage) blobDelete(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mb, ok := m.blobs[hash]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	delete(m.blobs, hash)
+	if mb.spilled {
+		return m.spillRemove(hash)
+	}
+	m.size -= int64(len(mb.data))
 	return nil
 }
 
+// memBuffer is a growing byte slice supporting WriteAt for the codec header
+type memBuffer struct {
+	buf []byte
+}
+
+func (mb *memBuffer) Write(p []byte) (int, error) {
+	mb.buf = append(mb.buf, p...)
+	return len(p), nil
+}
+
+func (mb *memBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(mb.buf)) {
+		return 0, fmt.Errorf("write at %d beyond buffer length %d", off, len(mb.buf))
+	}
+	return copy(mb.buf[off:], p), nil
+}
+
+// Flush waits for any running eviction, returning errors from evicting blobs to disk
+func (m *MemStorage) Flush() error {
+	m.evict.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := m.evictErr
+	m.evictErr = nil
+	return err
+}
+
+// Close waits for any running eviction and removes the temp dir of evicted blobs
+func (m *MemStorage) Close() error {
+	m.evict.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.tmpDir {
+		return nil
+	}
+	err := os.RemoveAll(m.dir)
+	m.dir = ""
+	m.tmpDir = false
+	return err
+}
+
 // Index returns the current index
 func (m *MemStorage) Index() Index {
 	return m.index
 }
 
-// PruneCache deletes any data from memory or cache that hasn't been recently accessed
-func (m *MemStorage) PruneCache(time.Duration) error {
-	return errNotImplemented
+// PruneCache deletes blobs that haven't been accessed within the duration and are not used by any root,
+// blobs still used by a root are moved to disk
+func (m *MemStorage) PruneCache(d time.Duration) error {
+	refs, err := m.blobRefs(false)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-d)
+	m.mu.Lock()
+	hashes := []string{}
+	for hash, mb := range m.blobs {
+		if mb.access.Before(cutoff) {
+			hashes = append(hashes, hash)
+		}
+	}
+	m.mu.Unlock()
+	for _, hash := range hashes {
+		if refs[hash] {
+			err = m.spill(hash)
+		} else {
+			err = m.blobDelete(hash)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
 }
 
 // PruneStorage deletes any blobs that are not used by any root
 func (m *MemStorage) PruneStorage() error {
-	return errNotImplemented
+	return ErrNotImplemented
 }
 
 // RootCreate returns a new root using a uuid
@@ -96,38 +270,286 @@ func (m *MemStorage) RootCreateFrom(hash string) (string, *Root, error) {
 	}
 	root := newRootHash(m, hash)
 	root.readonly = false
+	root.metaHash = m.index.Roots[hash].Meta
 	m.roots[u] = root
 	return u, root, nil
 }
 
 // RootOpen returns an existing root
 func (m *MemStorage) RootOpen(name string) (*Root, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if root, ok := m.roots[name]; ok {
 		return root, nil
 	}
 	if _, ok := m.index.Roots[name]; !ok {
 		return nil, fmt.Errorf("hash not found in index: %s", name)
 	}
-	m.mu.Lock()
-	defer m.mu.Unlock()
 	m.index.Roots[name].Used = time.Now()
 	root := newRootHash(m, name)
+	root.metaHash = m.index.Roots[name].Meta
 	m.roots[name] = root
 	return root, nil
 }
 
+// rootUsed updates the last used time of a root in the index
+func (m *MemStorage) rootUsed(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ir, ok := m.index.Roots[name]; ok {
+		ir.Used = time.Now()
+	}
+}
+
 // RootSave saves a root and adds the hash to the index
 func (m *MemStorage) RootSave(r *Root) (string, error) {
 	hash, err := r.Save()
 	if err != nil {
 		return "", err
 	}
+	metaHash, err := r.saveMeta()
+	if err != nil {
+		return "", err
+	}
+	ir := r.indexRoot(metaHash)
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	newRoot := newRootHash(m, hash)
+	newRoot.metaHash = metaHash
 	m.roots[hash] = newRoot
-	m.index.Roots[hash] = &IndexRoot{
-		Used: time.Now(),
-	}
+	ir.merge(m.index.Roots[hash])
+	m.index.Roots[hash] = &ir
 	return hash, nil
 }
+
+// evictLimit spills the least recently used blobs to disk until memory is within the limit,
+// blobs used by open uuid roots are only evicted after all other blobs
+func (m *MemStorage) evictLimit() {
+	defer m.evict.Done()
+	err := m.evictLRU()
+	m.mu.Lock()
+	m.evicting = false
+	if err != nil && m.evictErr == nil {
+		m.evictErr = err
+	}
+	m.mu.Unlock()
+}
+
+func (m *MemStorage) evictLRU() error {
+	open, err := m.blobRefs(true)
+	if err != nil {
+		return err
+	}
+	type lru struct {
+		hash   string
+		open   bool
+		access time.Time
+	}
+	m.mu.Lock()
+	list := []lru{}
+	for hash, mb := range m.blobs {
+		if !mb.spilled {
+			list = append(list, lru{hash: hash, open: open[hash], access: mb.access})
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].open != list[j].open {
+			return !list[i].open
+		}
+		return list[i].access.Before(list[j].access)
+	})
+	for _, l := range list {
+		m.mu.Lock()
+		done := m.size <= m.limit
+		m.mu.Unlock()
+		if done {
+			break
+		}
+		err = m.spill(l.hash)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobRefs returns the blobs used by open uuid roots, or by any root when openOnly is false
+func (m *MemStorage) blobRefs(openOnly bool) (map[string]bool, error) {
+	m.mu.Lock()
+	roots := []*Root{}
+	for name, root := range m.roots {
+		if !openOnly || strings.HasPrefix(name, "uuid:") {
+			roots = append(roots, root)
+		}
+	}
+	dirs := []string{}
+	refs := map[string]bool{}
+	if !openOnly {
+		for hash, ir := range m.index.Roots {
+			dirs = append(dirs, hash)
+			if ir.Meta != "" {
+				refs[ir.Meta] = true
+			}
+		}
+	}
+	m.mu.Unlock()
+	for _, root := range roots {
+		dirs = append(dirs, root.blobRefs(refs)...)
+	}
+	if openOnly {
+		// directories of the saved root a uuid was created from are not expanded
+		for _, hash := range dirs {
+			refs[hash] = true
+		}
+		return refs, nil
+	}
+	err := blobRefsStorage(dirs, refs, m.blobRead)
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// blobRead returns the content of a blob without updating the access time
+func (m *MemStorage) blobRead(hash string) ([]byte, error) {
+	m.mu.Lock()
+	mb, ok := m.blobs[hash]
+	if !ok {
+		m.mu.Unlock()
+		return nil, fs.ErrNotExist
+	}
+	var rdr io.ReadSeeker
+	var size int64
+	encoded := mb.encoded
+	if mb.spilled {
+		fh, err := m.spillOpen(hash)
+		if err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		defer fh.Close()
+		stat, err := fh.Stat()
+		if err != nil {
+			m.mu.Unlock()
+			return nil, err
+		}
+		rdr, size = fh, stat.Size()
+	} else {
+		rdr, size = bytes.NewReader(mb.data), int64(len(mb.data))
+	}
+	m.mu.Unlock()
+	br, err := m.cd.reader(rdr, size, encoded)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(br)
+}
+
+// spill moves a blob from memory to disk
+func (m *MemStorage) spill(hash string) error {
+	m.mu.Lock()
+	mb, ok := m.blobs[hash]
+	if !ok {
+		m.mu.Unlock()
+		return fs.ErrNotExist
+	}
+	if mb.spilled {
+		m.mu.Unlock()
+		return nil
+	}
+	data := mb.data
+	err := m.spillDir()
+	dir := m.dir
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// the file is written without the lock, the blob stays readable from memory until it is moved
+	fh, err := os.CreateTemp(filepath.Join(dir, fsTmpDir), "*")
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	errC := fh.Close()
+	if err == nil {
+		err = errC
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	// spilled blobs keep the raw path, the format is tracked by the memBlob
+	err = fsRename(fh.Name(), dir, hash, false)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mb, ok := m.blobs[hash]; ok && !mb.spilled {
+		m.size -= int64(len(mb.data))
+		mb.data = nil
+		mb.spilled = true
+	}
+	return nil
+}
+
+// spillDir creates the directory for evicted blobs, the caller must hold the lock
+func (m *MemStorage) spillDir() error {
+	if m.dir == "" {
+		dir, err := os.MkdirTemp("", "httplock-memory-")
+		if err != nil {
+			return err
+		}
+		m.dir = dir
+		m.tmpDir = true
+	}
+	return os.MkdirAll(filepath.Join(m.dir, fsTmpDir), 0777)
+}
+
+// spillOpen opens an evicted blob, the caller must hold the lock
+func (m *MemStorage) spillOpen(hash string) (*os.File, error) {
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(m.dir, blobPath))
+}
+
+// blobSize returns the size of a blob, in memory or spilled to disk
+func (m *MemStorage) blobSize(hash string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mb, ok := m.blobs[hash]
+	if !ok {
+		return 0, fs.ErrNotExist
+	}
+	if !mb.spilled {
+		if mb.encoded {
+			return codecSize(bytes.NewReader(mb.data))
+		}
+		return int64(len(mb.data)), nil
+	}
+	fh, err := m.spillOpen(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	if mb.encoded {
+		return codecSize(fh)
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// spillRemove deletes an evicted blob, the caller must hold the lock
+func (m *MemStorage) spillRemove(hash string) error {
+	blobPath, err := fsBlobPath(hash)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(m.dir, blobPath))
+}
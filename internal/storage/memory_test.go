@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+func TestMemoryLimit(t *testing.T) {
+	m := newMemory(nil)
+	m.limit = 1000
+	m.dir = t.TempDir()
+	blobA := bytes.Repeat([]byte("a"), 600)
+	blobB := bytes.Repeat([]byte("b"), 600)
+	blobC := bytes.Repeat([]byte("c"), 600)
+
+	// blob a is used by an open root, b and c are not referenced
+	_, root, err := m.RootCreate()
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	bw, err := root.Write([]string{"a"})
+	if err != nil {
+		t.Errorf("failed to create blob: %v", err)
+		return
+	}
+	hashes := []string{}
+	for _, blob := range [][]byte{blobA, blobB, blobC} {
+		if len(hashes) > 0 {
+			bw, err = m.BlobCreate()
+			if err != nil {
+				t.Errorf("failed to create blob: %v", err)
+				return
+			}
+		}
+		_, err = bw.Write(blob)
+		if err != nil {
+			t.Errorf("failed to write blob: %v", err)
+			return
+		}
+		err = bw.Close()
+		if err != nil {
+			t.Errorf("failed to close blob: %v", err)
+			return
+		}
+		hash, err := bw.Hash()
+		if err != nil {
+			t.Errorf("failed to get hash: %v", err)
+			return
+		}
+		hashes = append(hashes, hash)
+	}
+	err = m.Flush()
+	if err != nil {
+		t.Errorf("eviction failed: %v", err)
+		return
+	}
+	if m.size > m.limit {
+		t.Errorf("memory exceeds limit after eviction: %d", m.size)
+	}
+	if m.blobs[hashes[0]].spilled {
+		t.Errorf("blob used by an open root was evicted before unused blobs")
+	}
+	if !m.blobs[hashes[1]].spilled {
+		t.Errorf("least recently used blob was not evicted")
+	}
+	for i, blob := range [][]byte{blobA, blobB, blobC} {
+		br, err := m.BlobOpen(hashes[i])
+		if err != nil {
+			t.Errorf("failed to open blob %d: %v", i, err)
+			return
+		}
+		b, err := io.ReadAll(br)
+		br.Close()
+		if err != nil || !bytes.Equal(b, blob) {
+			t.Errorf("blob %d mismatch: %v", i, err)
+		}
+	}
+
+	// prune removes unused blobs and moves used blobs to disk
+	err = m.PruneCache(0)
+	if err != nil {
+		t.Errorf("failed to prune: %v", err)
+		return
+	}
+	if m.size != 0 {
+		t.Errorf("blobs remain in memory after prune: %d bytes", m.size)
+	}
+	for i := range hashes[1:] {
+		_, err = m.BlobOpen(hashes[i+1])
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("unused blob %d was not pruned: %v", i+1, err)
+		}
+		_, err = m.spillOpen(hashes[i+1])
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("unused blob %d was not removed from disk: %v", i+1, err)
+		}
+	}
+	br, err := root.Read([]string{"a"})
+	if err != nil {
+		t.Errorf("failed to read pruned blob used by root: %v", err)
+		return
+	}
+	b, err := io.ReadAll(br)
+	br.Close()
+	if err != nil || !bytes.Equal(b, blobA) {
+		t.Errorf("blob mismatch after prune: %v", err)
+	}
+
+	// saved roots keep their blobs
+	hash, err := m.RootSave(root)
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+	// drop the open roots so only the index references the blobs
+	for name := range m.roots {
+		delete(m.roots, name)
+	}
+	err = m.PruneCache(0)
+	if err != nil {
+		t.Errorf("failed to prune: %v", err)
+		return
+	}
+	rootSaved, err := m.RootOpen(hash)
+	if err != nil {
+		t.Errorf("failed to open saved root: %v", err)
+		return
+	}
+	br, err = rootSaved.Read([]string{"a"})
+	if err != nil {
+		t.Errorf("failed to read blob from saved root: %v", err)
+		return
+	}
+	br.Close()
+}
+
+func TestMemoryClose(t *testing.T) {
+	tt := []struct {
+		name string
+		dir  string
+		keep bool
+	}{
+		{
+			name: "temp dir",
+		},
+		{
+			name: "configured dir",
+			dir:  t.TempDir(),
+			keep: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMemory(nil)
+			m.limit = 100
+			m.dir = tc.dir
+			bw, err := m.BlobCreate()
+			if err != nil {
+				t.Errorf("failed to create blob: %v", err)
+				return
+			}
+			_, err = bw.Write(bytes.Repeat([]byte("a"), 200))
+			if err != nil {
+				t.Errorf("failed to write blob: %v", err)
+				return
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Errorf("failed to close blob: %v", err)
+				return
+			}
+			err = m.Flush()
+			if err != nil {
+				t.Errorf("eviction failed: %v", err)
+				return
+			}
+			dir := m.dir
+			if dir == "" {
+				t.Errorf("blob was not spilled to disk")
+				return
+			}
+			err = m.Close()
+			if err != nil {
+				t.Errorf("failed to close: %v", err)
+				return
+			}
+			_, err = os.Stat(dir)
+			if tc.keep && err != nil {
+				t.Errorf("configured dir was removed: %v", err)
+			} else if !tc.keep && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("temp dir was not removed: %v", err)
+			}
+		})
+	}
+}
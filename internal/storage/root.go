@@ -5,20 +5,36 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
 )
 
+// Root is a tree of directories and files, methods are safe for concurrent use
 type Root struct {
+	mu       sync.Mutex
 	storage  Storage
 	hash     string
 	dir      *Dir
 	readonly bool
+	conf     config.Token
+	meta     map[string]json.RawMessage // metadata for paths, excluded from the hash
+	metaHash string                     // blob containing the metadata, loaded on first use
+	algo     string                     // hash algorithm of new blobs, empty for the storage default
+	info     RootInfo                   // added to the index when saved
+	seq      uint64                     // creation order, used to lock multiple roots
 }
 
+// rootSeq numbers each root as it is created
+var rootSeq atomic.Uint64
+
 type Dir struct {
-	mu      sync.Mutex
 	hash    string
 	Entries map[string]*DirEntry `json:"entries"`
 }
@@ -48,18 +64,26 @@ func newRoot(s Storage) *Root {
 		dir: &Dir{
 			Entries: map[string]*DirEntry{},
 		},
+		seq: rootSeq.Add(1),
 	}
 }
+
+// newRootHash returns a root for an existing hash, new blobs keep the algorithm of that hash
 func newRootHash(s Storage, hash string) *Root {
+	algo, _ := hasher.Algorithm(hash)
 	return &Root{
 		storage:  s,
 		hash:     hash,
 		readonly: true,
+		algo:     algo,
+		seq:      rootSeq.Add(1),
 	}
 }
 
 // EntryHash returns the hash of a path entry
 func (r *Root) EntryHash(path []string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	dCur, err := r.getDir(path[:len(path)-1], false)
 	if err != nil {
 		return "", err
@@ -90,12 +114,12 @@ func (r *Root) EntryHash(path []string) (string, error) {
 
 // Link references an existing blob as a file in a directory
 func (r *Root) Link(path []string, blob string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	dCur, err := r.getDir(path[:len(path)-1], true)
 	if err != nil {
 		return err
 	}
-	dCur.mu.Lock()
-	defer dCur.mu.Unlock()
 	name := path[len(path)-1]
 	if entry, ok := dCur.Entries[name]; ok {
 		if entry.Kind != KindFile {
@@ -111,17 +135,54 @@ func (r *Root) Link(path []string, blob string) error {
 	return nil
 }
 
-// List returns the directory entries in a root
+// LinkAbsent references existing blobs as files in a directory when none of the names already exist,
+// the check and the links are made under one lock so only the first caller adds the files
+func (r *Root) LinkAbsent(path []string, files map[string]string) (bool, error) {
+	if r.readonly {
+		return false, errReadOnly
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dCur, err := r.getDir(path, true)
+	if err != nil {
+		return false, err
+	}
+	for name := range files {
+		if _, ok := dCur.Entries[name]; ok {
+			return false, nil
+		}
+	}
+	for name, blob := range files {
+		dCur.Entries[name] = &DirEntry{
+			Kind: KindFile,
+			file: &File{hash: blob},
+		}
+	}
+	return true, nil
+}
+
+// List returns a copy of the directory entries in a root
 func (r *Root) List(path []string) (map[string]*DirEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	dCur, err := r.getDir(path, false)
 	if err != nil {
 		return nil, err
 	}
-	return dCur.Entries, nil
+	entries := make(map[string]*DirEntry, len(dCur.Entries))
+	for name, entry := range dCur.Entries {
+		entries[name] = &DirEntry{
+			Hash: entry.Hash,
+			Kind: entry.Kind,
+		}
+	}
+	return entries, nil
 }
 
 // ListHashes returns a slice of hashes representing all entries in a root
 func (r *Root) ListHashes() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	err := r.loadRoot()
 	if err != nil {
 		return nil, err
@@ -145,7 +206,7 @@ func (r *Root) ListHashes() ([]string, error) {
 			return nil
 		},
 	}
-	err = r.Walk(fns)
+	err = r.walkDir(fns, r.dir)
 	if err != nil {
 		return nil, err
 	}
@@ -154,6 +215,8 @@ func (r *Root) ListHashes() ([]string, error) {
 
 // Read returns a reader for a given file
 func (r *Root) Read(path []string) (BlobReader, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	dCur, err := r.getDir(path[:len(path)-1], false)
 	if err != nil {
 		return nil, err
@@ -176,6 +239,180 @@ func (r *Root) Read(path []string) (BlobReader, error) {
 	return r.storage.BlobOpen(entry.Hash)
 }
 
+// Conf returns the token configuration of the root
+func (r *Root) Conf() config.Token {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conf
+}
+
+// SetConf sets the token configuration of the root
+func (r *Root) SetConf(conf config.Token) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conf = conf
+}
+
+// Info returns the user metadata added to the index when the root is saved
+func (r *Root) Info() RootInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.info
+}
+
+// SetInfo sets the user metadata added to the index when the root is saved
+func (r *Root) SetInfo(info RootInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.info = info
+}
+
+// Stats counts the files with a name ending in suffix and sums the size of the unique files in the root,
+// sizes are looked up from storage without reading the content
+func (r *Root) Stats(suffix string) (int, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.loadRoot()
+	if err != nil {
+		return 0, 0, err
+	}
+	if !r.readonly {
+		err = r.hashDir(r.dir)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	count := 0
+	var size int64
+	seen := map[string]bool{}
+	dirs := []*Dir{r.dir}
+	for len(dirs) > 0 {
+		d := dirs[0]
+		dirs = dirs[1:]
+		for name, entry := range d.Entries {
+			if entry.Kind == KindDir {
+				if entry.dir == nil {
+					entry.dir, err = r.loadDir(entry.Hash)
+					if err != nil {
+						return 0, 0, err
+					}
+				}
+				dirs = append(dirs, entry.dir)
+				continue
+			}
+			if strings.HasSuffix(name, suffix) {
+				count++
+			}
+			if entry.Hash == "" || seen[entry.Hash] {
+				continue
+			}
+			seen[entry.Hash] = true
+			blobSz, err := blobSize(r.storage, entry.Hash)
+			if err != nil {
+				return 0, 0, err
+			}
+			size += blobSz
+		}
+	}
+	return count, size, nil
+}
+
+// indexRoot returns the index entry for the saved root, the creation time defaults to now
+func (r *Root) indexRoot(metaHash string) IndexRoot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	ir := IndexRoot{
+		Used:     now,
+		Meta:     metaHash,
+		RootInfo: r.info,
+	}
+	if ir.Created.IsZero() {
+		ir.Created = now
+	}
+	return ir
+}
+
+// merge keeps the metadata of a previous save of the same hash that is not replaced by the new save,
+// labels from the new save replace all previous labels, an empty map removes them and nil keeps them
+func (ir *IndexRoot) merge(prev *IndexRoot) {
+	if prev == nil {
+		return
+	}
+	if !prev.Created.IsZero() && prev.Created.Before(ir.Created) {
+		ir.Created = prev.Created
+	}
+	if ir.Labels == nil {
+		ir.Labels = prev.Labels
+	}
+	if ir.Description == "" {
+		ir.Description = prev.Description
+	}
+	if ir.Creator == "" {
+		ir.Creator = prev.Creator
+	}
+	if ir.Requests == 0 {
+		ir.Requests = prev.Requests
+	}
+	if ir.Bytes == 0 {
+		ir.Bytes = prev.Bytes
+	}
+}
+
+// SetMeta stores metadata for a path, metadata is saved with the root but is not included in the hash
+func (r *Root) SetMeta(path []string, v interface{}) error {
+	if r.readonly {
+		return errReadOnly
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err = r.loadMeta()
+	if err != nil {
+		return err
+	}
+	r.meta[strings.Join(path, "\n")] = j
+	return nil
+}
+
+// GetMeta unmarshals the metadata for a path into v, returning fs.ErrNotExist if no metadata is found
+func (r *Root) GetMeta(path []string, v interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.loadMeta()
+	if err != nil {
+		return err
+	}
+	j, ok := r.meta[strings.Join(path, "\n")]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	return json.Unmarshal(j, v)
+}
+
+// ListMeta returns the paths that have metadata
+func (r *Root) ListMeta() ([][]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.loadMeta()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(r.meta))
+	for k := range r.meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	paths := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		paths = append(paths, strings.Split(k, "\n"))
+	}
+	return paths, nil
+}
+
 // ReadOnly returns true if the root is read-only (loaded from an immutable hash)
 func (r *Root) ReadOnly() bool {
 	return r.readonly
@@ -183,6 +420,8 @@ func (r *Root) ReadOnly() bool {
 
 // Save computes and returns the hash of the root
 func (r *Root) Save() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if !r.readonly && r.dir != nil {
 		err := r.hashDir(r.dir)
 		if err != nil {
@@ -201,7 +440,10 @@ type WalkFns struct {
 	fnFile func(*File) error
 }
 
+// Walk calls fns on every directory and file in the root, fns must not call other methods on the root
 func (r *Root) Walk(fns WalkFns) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	err := r.loadRoot()
 	if err != nil {
 		return err
@@ -251,12 +493,12 @@ func (r *Root) Write(path []string) (BlobWriter, error) {
 	if r.readonly {
 		return nil, errReadOnly
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	dCur, err := r.getDir(path[:len(path)-1], true)
 	if err != nil {
 		return nil, err
 	}
-	dCur.mu.Lock()
-	defer dCur.mu.Unlock()
 	name := path[len(path)-1]
 	if entry, ok := dCur.Entries[name]; ok {
 		if entry.Kind != KindFile {
@@ -278,7 +520,7 @@ func (r *Root) Write(path []string) (BlobWriter, error) {
 		}
 	}
 	// create blob writer, update
-	bw, err := r.storage.BlobCreate()
+	bw, err := r.BlobCreate()
 	if err != nil {
 		return nil, err
 	}
@@ -286,6 +528,15 @@ func (r *Root) Write(path []string) (BlobWriter, error) {
 	return bw, nil
 }
 
+// BlobCreate returns a writer for a blob using the algorithm of the root, the blob is not added to the root until it is linked
+func (r *Root) BlobCreate() (BlobWriter, error) {
+	if r.algo == "" {
+		return r.storage.BlobCreate()
+	}
+	return r.storage.BlobCreate(WithAlgorithm(r.algo))
+}
+
+// getDir and the other internal methods expect the caller to hold the root lock
 func (r *Root) getDir(path []string, write bool) (*Dir, error) {
 	// fail if root is read-only
 	if r.readonly && write {
@@ -324,12 +575,10 @@ func (r *Root) getDir(path []string, write bool) (*Dir, error) {
 			dir := &Dir{
 				Entries: map[string]*DirEntry{},
 			}
-			dCur.mu.Lock()
 			dCur.Entries[name] = &DirEntry{
 				Kind: KindDir,
 				dir:  dir,
 			}
-			dCur.mu.Unlock()
 			dCur = dir
 		} else {
 			return nil, fmt.Errorf("%s not found", strings.Join(path[:i+1], "/"))
@@ -366,7 +615,7 @@ func (r *Root) hashDir(d *Dir) error {
 	if err != nil {
 		return err
 	}
-	bw, err := r.storage.BlobCreate()
+	bw, err := r.BlobCreate()
 	if err != nil {
 		return err
 	}
@@ -429,7 +678,136 @@ func (r *Root) loadRoot() error {
 	return nil
 }
 
+func (r *Root) loadMeta() error {
+	if r.meta != nil {
+		return nil
+	}
+	meta := map[string]json.RawMessage{}
+	if r.metaHash != "" {
+		br, err := r.storage.BlobOpen(r.metaHash)
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(br).Decode(&meta)
+		br.Close()
+		if err != nil {
+			return err
+		}
+	}
+	r.meta = meta
+	return nil
+}
+
+// saveMeta writes the metadata to a blob, returning an empty hash when there is no metadata
+func (r *Root) saveMeta() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.meta) == 0 {
+		return r.metaHash, nil
+	}
+	j, err := json.Marshal(r.meta)
+	if err != nil {
+		return "", err
+	}
+	bw, err := r.BlobCreate()
+	if err != nil {
+		return "", err
+	}
+	_, err = bw.Write(j)
+	bw.Close()
+	if err != nil {
+		return "", err
+	}
+	return bw.Hash()
+}
+
+// blobRefs adds the blobs referenced by the root without loading from storage,
+// returning the hashes of directories that have not been loaded
+func (r *Root) blobRefs(refs map[string]bool) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.metaHash != "" {
+		refs[r.metaHash] = true
+	}
+	if r.dir == nil {
+		if r.hash == "" {
+			return nil
+		}
+		return []string{r.hash}
+	}
+	if r.hash != "" {
+		refs[r.hash] = true
+	}
+	return r.blobRefsDir(r.dir, refs, nil)
+}
+
+func (r *Root) blobRefsDir(d *Dir, refs map[string]bool, unloaded []string) []string {
+	if d.hash != "" {
+		refs[d.hash] = true
+	}
+	for _, entry := range d.Entries {
+		switch entry.Kind {
+		case KindDir:
+			if entry.dir != nil {
+				// loaded directories keep the hash in the entry until modified
+				if entry.Hash != "" {
+					refs[entry.Hash] = true
+				}
+				unloaded = r.blobRefsDir(entry.dir, refs, unloaded)
+			} else if entry.Hash != "" {
+				unloaded = append(unloaded, entry.Hash)
+			}
+		case KindFile:
+			if entry.Hash != "" {
+				refs[entry.Hash] = true
+			}
+			if entry.file != nil && entry.file.hash != "" {
+				refs[entry.file.hash] = true
+			}
+			if entry.file != nil && entry.file.blobW != nil {
+				// blobs still being written are not yet in storage
+				if hash, err := entry.file.blobW.Hash(); err == nil {
+					refs[hash] = true
+				}
+			}
+		}
+	}
+	return unloaded
+}
+
+// blobRefsStorage adds the blobs referenced by saved directories, reading each directory with readFn
+func blobRefsStorage(dirs []string, refs map[string]bool, readFn func(hash string) ([]byte, error)) error {
+	for len(dirs) > 0 {
+		hash := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		if refs[hash] {
+			continue
+		}
+		refs[hash] = true
+		dj, err := readFn(hash)
+		if err != nil {
+			return err
+		}
+		d := Dir{}
+		err = json.Unmarshal(dj, &d)
+		if err != nil {
+			return err
+		}
+		for _, entry := range d.Entries {
+			switch entry.Kind {
+			case KindDir:
+				dirs = append(dirs, entry.Hash)
+			case KindFile:
+				refs[entry.Hash] = true
+			}
+		}
+	}
+	return nil
+}
+
 func (r *Root) report() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	var err error
 	if r.dir == nil {
 		r.dir, err = r.loadDir(r.hash)
@@ -528,6 +906,17 @@ func DiffRoots(r1, r2 *Root) (DiffReport, error) {
 	dr := DiffReport{
 		Entries: []DiffEntry{},
 	}
+	// roots are locked in creation order so concurrent diffs of the same roots cannot deadlock
+	first, second := r1, r2
+	if second.seq < first.seq {
+		first, second = second, first
+	}
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if second != first {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
 
 	if !r1.readonly && r1.dir != nil {
 		err := r1.hashDir(r1.dir)
@@ -3,8 +3,12 @@ package storage
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/httplock/httplock/internal/config"
@@ -281,4 +285,479 @@ func TestRoot(t *testing.T) {
 	}
 	t.Logf("Report:\n%s", string(drj))
 
+	// diffs in both directions at the same time must not deadlock
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for _, pair := range [][2]*Root{{r1, r2}, {r2, r1}} {
+		wg.Add(1)
+		go func(a, b *Root) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				if _, err := DiffRoots(a, b); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(pair[0], pair[1])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent diff failed: %v", err)
+	}
+}
+
+func TestRootConcurrent(t *testing.T) {
+	workers := 8
+	files := 20
+	s, err := NewMemory()
+	if err != nil {
+		t.Errorf("failed to load storage: %v", err)
+		return
+	}
+	writeFile := func(r *Root, path []string, content []byte) error {
+		bw, err := r.Write(path)
+		if err != nil {
+			return err
+		}
+		_, err = bw.Write(content)
+		if err != nil {
+			return err
+		}
+		return bw.Close()
+	}
+	genPath := func(w, f int) []string {
+		return []string{fmt.Sprintf("host%d", w%3), fmt.Sprintf("dir%d", w), fmt.Sprintf("file%d", f)}
+	}
+	genContent := func(w, f int) []byte {
+		return []byte(fmt.Sprintf("worker %d file %d", w, f))
+	}
+
+	// build the expected root sequentially
+	_, rSeq, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	for w := 0; w < workers; w++ {
+		for f := 0; f < files; f++ {
+			err = writeFile(rSeq, genPath(w, f), genContent(w, f))
+			if err != nil {
+				t.Errorf("failed to write file: %v", err)
+				return
+			}
+		}
+	}
+	hashSeq, err := rSeq.Save()
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+
+	// hammer a single uuid with writes, reads, and saves
+	u, _, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*2)
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			r, err := s.RootOpen(u)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for f := 0; f < files; f++ {
+				path := genPath(w, f)
+				err = writeFile(r, path, genContent(w, f))
+				if err != nil {
+					errs <- err
+					return
+				}
+				br, err := r.Read(path)
+				if err != nil {
+					errs <- err
+					return
+				}
+				b, err := io.ReadAll(br)
+				br.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(b, genContent(w, f)) {
+					errs <- fmt.Errorf("content mismatch on %v: %s", path, b)
+					return
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			r, err := s.RootOpen(u)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for f := 0; f < files; f++ {
+				// entries may not exist yet, only races are being checked
+				_, _ = r.EntryHash(genPath(w, f))
+				_, _ = r.List([]string{fmt.Sprintf("host%d", w%3)})
+				_, _ = r.ListHashes()
+				_, _ = r.Save()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent access failed: %v", err)
+	}
+	r, err := s.RootOpen(u)
+	if err != nil {
+		t.Errorf("failed to open root: %v", err)
+		return
+	}
+	hash1, err := r.Save()
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+	hash2, err := r.Save()
+	if err != nil {
+		t.Errorf("failed to save root: %v", err)
+		return
+	}
+	if hash1 != hash2 {
+		t.Errorf("hash changed between saves, %s != %s", hash1, hash2)
+	}
+	if hash1 != hashSeq {
+		t.Errorf("hash mismatch with sequential writes, expected %s, received %s", hashSeq, hash1)
+	}
+}
+
+func TestRootLinkAbsent(t *testing.T) {
+	workers := 8
+	path := []string{"host", "dir"}
+	s, err := NewMemory()
+	if err != nil {
+		t.Errorf("failed to load storage: %v", err)
+		return
+	}
+	_, r, err := s.RootCreate()
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	blobs := make([]string, workers)
+	for w := range blobs {
+		bw, err := r.BlobCreate()
+		if err != nil {
+			t.Errorf("failed to create blob: %v", err)
+			return
+		}
+		_, err = bw.Write([]byte(fmt.Sprintf("worker %d", w)))
+		bw.Close()
+		if err != nil {
+			t.Errorf("failed to write blob: %v", err)
+			return
+		}
+		blobs[w], err = bw.Hash()
+		if err != nil {
+			t.Errorf("failed to get hash: %v", err)
+			return
+		}
+	}
+	// only one of the concurrent callers may add the files
+	var wg sync.WaitGroup
+	added := make(chan int, workers)
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ok, err := r.LinkAbsent(path, map[string]string{"head": blobs[w], "body": blobs[w]})
+			if err != nil {
+				errs <- err
+			} else if ok {
+				added <- w
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(added)
+	close(errs)
+	for err := range errs {
+		t.Errorf("link absent failed: %v", err)
+	}
+	winners := []int{}
+	for w := range added {
+		winners = append(winners, w)
+	}
+	if len(winners) != 1 {
+		t.Errorf("expected one caller to add the files, received %v", winners)
+		return
+	}
+	for _, name := range []string{"head", "body"} {
+		hash, err := r.EntryHash(append(path, name))
+		if err != nil {
+			t.Errorf("failed to get hash of %s: %v", name, err)
+		} else if hash != blobs[winners[0]] {
+			t.Errorf("%s links %s, expected %s", name, hash, blobs[winners[0]])
+		}
+	}
+	// a partial match also leaves the directory unchanged
+	ok, err := r.LinkAbsent(path, map[string]string{"other": blobs[0], "head": blobs[0]})
+	if err != nil {
+		t.Errorf("link absent failed: %v", err)
+	} else if ok {
+		t.Errorf("link absent replaced an existing file")
+	}
+	if _, err := r.EntryHash(append(path, "other")); err == nil {
+		t.Errorf("link absent added a file when another name existed")
+	}
+}
+
+func TestRootStats(t *testing.T) {
+	files := map[string][]byte{
+		"host/dir/a-resp-head": []byte("head a"),
+		"host/dir/a-resp-body": []byte("body content"),
+		"host/dir/b-resp-head": []byte("head b"),
+		"host/dir/b-resp-body": []byte("body content"),
+		"host/other/c-policy":  []byte("policy"),
+	}
+	// unique content: "head a", "head b", "body content", "policy"
+	expectSize := int64(6 + 6 + 12 + 6)
+	cd, err := newCodec(config.Storage{Compression: "gzip"})
+	if err != nil {
+		t.Errorf("failed to create codec: %v", err)
+		return
+	}
+	sMem, _ := NewMemory()
+	sFS, err := newFilesystem(t.TempDir(), cd, "", false)
+	if err != nil {
+		t.Errorf("failed to create filesystem storage: %v", err)
+		return
+	}
+	sBolt, err := newBolt(t.TempDir(), cd, "", false)
+	if err != nil {
+		t.Errorf("failed to create bolt storage: %v", err)
+		return
+	}
+	defer sBolt.(*BoltStorage).Close()
+	tests := []struct {
+		name string
+		s    Storage
+	}{
+		{name: "memory", s: sMem},
+		{name: "filesystem gzip", s: sFS},
+		{name: "bolt gzip", s: sBolt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, r, err := tt.s.RootCreate()
+			if err != nil {
+				t.Errorf("failed to create root: %v", err)
+				return
+			}
+			for path, content := range files {
+				bw, err := r.Write(strings.Split(path, "/"))
+				if err != nil {
+					t.Errorf("failed to write: %v", err)
+					return
+				}
+				_, err = bw.Write(content)
+				bw.Close()
+				if err != nil {
+					t.Errorf("failed to write: %v", err)
+					return
+				}
+			}
+			// stats are available before the root is saved and after it is reopened by hash
+			count, size, err := r.Stats("-resp-head")
+			if err != nil {
+				t.Errorf("failed to get stats: %v", err)
+				return
+			}
+			if count != 2 || size != expectSize {
+				t.Errorf("unexpected stats, expected 2 and %d, received %d and %d", expectSize, count, size)
+			}
+			hash, err := tt.s.RootSave(r)
+			if err != nil {
+				t.Errorf("failed to save root: %v", err)
+				return
+			}
+			rHash, err := tt.s.RootOpen(hash)
+			if err != nil {
+				t.Errorf("failed to open root: %v", err)
+				return
+			}
+			count, size, err = rHash.Stats("-resp-head")
+			if err != nil {
+				t.Errorf("failed to get stats: %v", err)
+				return
+			}
+			if count != 2 || size != expectSize {
+				t.Errorf("unexpected stats after save, expected 2 and %d, received %d and %d", expectSize, count, size)
+			}
+		})
+	}
+}
+
+func TestRootInfoLabels(t *testing.T) {
+	s, err := NewMemory()
+	if err != nil {
+		t.Errorf("failed to load storage: %v", err)
+		return
+	}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		expect map[string]string
+	}{
+		{
+			name:   "first save",
+			labels: map[string]string{"branch": "main", "job": "1"},
+			expect: map[string]string{"branch": "main", "job": "1"},
+		},
+		{
+			name:   "replace",
+			labels: map[string]string{"branch": "release"},
+			expect: map[string]string{"branch": "release"},
+		},
+		{
+			name:   "keep when unset",
+			expect: map[string]string{"branch": "release"},
+		},
+		{
+			name:   "remove",
+			labels: map[string]string{},
+			expect: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// every save has the same content and hash
+			_, r, err := s.RootCreate()
+			if err != nil {
+				t.Errorf("failed to create root: %v", err)
+				return
+			}
+			bw, err := r.Write([]string{"dir", "file"})
+			if err != nil {
+				t.Errorf("failed to write: %v", err)
+				return
+			}
+			_, err = bw.Write([]byte("labeled content"))
+			bw.Close()
+			if err != nil {
+				t.Errorf("failed to write: %v", err)
+				return
+			}
+			r.SetInfo(RootInfo{Labels: tt.labels})
+			hash, err := s.RootSave(r)
+			if err != nil {
+				t.Errorf("failed to save root: %v", err)
+				return
+			}
+			labels := s.Index().Roots[hash].Labels
+			if len(labels) != len(tt.expect) {
+				t.Errorf("unexpected labels, expected %v, received %v", tt.expect, labels)
+				return
+			}
+			for k, v := range tt.expect {
+				if labels[k] != v {
+					t.Errorf("unexpected labels, expected %v, received %v", tt.expect, labels)
+				}
+			}
+		})
+	}
+}
+
+func TestRootMeta(t *testing.T) {
+	type testMeta struct {
+		Count int
+	}
+	path := []string{"dir", "file"}
+	s, err := NewMemory()
+	if err != nil {
+		t.Errorf("failed to load storage: %v", err)
+		return
+	}
+	hashes := []string{}
+	for _, count := range []int{0, 1, 2} {
+		_, r, err := s.RootCreate()
+		if err != nil {
+			t.Errorf("failed to create root: %v", err)
+			return
+		}
+		bw, err := r.Write(path)
+		if err != nil {
+			t.Errorf("failed to create writer: %v", err)
+			return
+		}
+		_, err = bw.Write([]byte("content"))
+		bw.Close()
+		if err != nil {
+			t.Errorf("failed to write blob: %v", err)
+			return
+		}
+		if count > 0 {
+			err = r.SetMeta(path, testMeta{Count: count})
+			if err != nil {
+				t.Errorf("failed to set meta: %v", err)
+				return
+			}
+		}
+		hash, err := s.RootSave(r)
+		if err != nil {
+			t.Errorf("failed to save root: %v", err)
+			return
+		}
+		hashes = append(hashes, hash)
+	}
+	// metadata is excluded from the hash
+	if hashes[0] != hashes[1] || hashes[1] != hashes[2] {
+		t.Errorf("metadata changed the root hash: %v", hashes)
+	}
+	// the last save of a hash includes its metadata
+	rSaved, err := s.RootOpen(hashes[0])
+	if err != nil {
+		t.Errorf("failed to open root: %v", err)
+		return
+	}
+	tm := testMeta{}
+	err = rSaved.GetMeta(path, &tm)
+	if err != nil {
+		t.Errorf("failed to get meta: %v", err)
+		return
+	}
+	if tm.Count != 2 {
+		t.Errorf("unexpected meta, expected 2, received %d", tm.Count)
+	}
+	err = rSaved.GetMeta([]string{"missing"}, &tm)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("unexpected error for missing meta: %v", err)
+	}
+	err = rSaved.SetMeta(path, tm)
+	if err == nil {
+		t.Errorf("set meta on a read-only root succeeded")
+	}
+	// metadata is copied to new roots created from a hash
+	_, rFrom, err := s.RootCreateFrom(hashes[0])
+	if err != nil {
+		t.Errorf("failed to create root: %v", err)
+		return
+	}
+	paths, err := rFrom.ListMeta()
+	if err != nil {
+		t.Errorf("failed to list meta: %v", err)
+		return
+	}
+	if len(paths) != 1 || strings.Join(paths[0], "/") != strings.Join(path, "/") {
+		t.Errorf("unexpected meta paths: %v", paths)
+	}
 }
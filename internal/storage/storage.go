@@ -10,7 +10,8 @@ import (
 )
 
 var (
-	errNotImplemented = errors.New("not implemented")
+	// ErrNotImplemented is returned for operations the storage kind does not support
+	ErrNotImplemented = errors.New("not implemented")
 	errReadOnly       = errors.New("read only")
 )
 
@@ -28,8 +29,8 @@ type fileHTTPLock struct {
 type Storage interface {
 	// BlobOpen returns a reader for a blob
 	BlobOpen(blob string) (BlobReader, error)
-	// BlobCreate returns a writer for a blob
-	BlobCreate() (BlobWriter, error)
+	// BlobCreate returns a writer for a blob, hashed with the storage default algorithm unless set with WithAlgorithm
+	BlobCreate(opts ...BlobOpt) (BlobWriter, error)
 	// Flush writes any data cached to the backend storage
 	Flush() error
 	// Index returns the current index
@@ -48,6 +49,25 @@ type Storage interface {
 	RootSave(r *Root) (string, error)
 }
 
+// blobSizer is implemented by storage that can return the size of a blob without opening a reader
+type blobSizer interface {
+	// blobSize returns the size of the blob content
+	blobSize(hash string) (int64, error)
+}
+
+// blobSize returns the size of a blob, falling back to opening the blob when the storage has no size lookup
+func blobSize(s Storage, hash string) (int64, error) {
+	if bs, ok := s.(blobSizer); ok {
+		return bs.blobSize(hash)
+	}
+	br, err := s.BlobOpen(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer br.Close()
+	return br.Size(), nil
+}
+
 // Index lists the known roots stored by hash
 type Index struct {
 	Roots map[string]*IndexRoot `json:"roots"`
@@ -56,6 +76,18 @@ type Index struct {
 // IndexRoot describes the metadata for a root
 type IndexRoot struct {
 	Used time.Time `json:"used,omitempty"`
+	Meta string    `json:"meta,omitempty"` // blob with metadata excluded from the root hash
+	RootInfo
+}
+
+// RootInfo is user metadata saved with a root in the index
+type RootInfo struct {
+	Labels      map[string]string `json:"labels,omitempty"` // e.g. project, branch, commit, or CI job
+	Description string            `json:"description,omitempty"`
+	Created     time.Time         `json:"created,omitempty"`
+	Creator     string            `json:"creator,omitempty"`  // token that recorded the root
+	Requests    int               `json:"requests,omitempty"` // number of recorded requests
+	Bytes       int64             `json:"bytes,omitempty"`    // total size of the blobs in the root
 }
 
 var registered = map[string]func(config.Config) (Storage, error){}
@@ -13,14 +13,10 @@ import (
 
 func TestStorage(t *testing.T) {
 	sampleBlob := []byte("sample blob")
-	sampleHash, err := hasher.FromBytes(sampleBlob)
-	if err != nil {
-		t.Errorf("failed to get sample blob hash: %v", err)
-		return
-	}
 	tests := []struct {
 		name string
 		conf string
+		algo string
 	}{
 		{
 			name: "memory",
@@ -30,11 +26,64 @@ func TestStorage(t *testing.T) {
 			name: "filesystem",
 			conf: fmt.Sprintf(`{"storage": {"kind": "filesystem", "directory": "%s"}}`, t.TempDir()),
 		},
+		{
+			name: "memory-gzip",
+			conf: `{"storage": {"kind": "memory", "compression": "gzip"}}`,
+		},
+		{
+			name: "filesystem-zstd",
+			conf: fmt.Sprintf(`{"storage": {"kind": "filesystem", "directory": "%s", "compression": "zstd"}}`, t.TempDir()),
+		},
+		{
+			name: "bolt",
+			conf: fmt.Sprintf(`{"storage": {"kind": "bolt", "directory": "%s"}}`, t.TempDir()),
+		},
+		{
+			name: "tiered",
+			conf: fmt.Sprintf(`{"storage": {"kind": "tiered", "local": {"kind": "memory"}, "remote": {"kind": "filesystem", "directory": "%s"}}}`, t.TempDir()),
+		},
+		{
+			name: "tiered-writeback",
+			conf: fmt.Sprintf(`{"storage": {"kind": "tiered", "writeBack": true, "local": {"kind": "filesystem", "directory": "%s"}, "remote": {"kind": "memory"}}}`, t.TempDir()),
+		},
+		{
+			name: "bolt-encrypted",
+			conf: fmt.Sprintf(`{"storage": {"kind": "bolt", "directory": "%s", "encryption": {"keys": [{"id": "test", "key": "MDEyMzQ1Njc4OWFiY2RlZg=="}]}}}`, t.TempDir()),
+		},
+		{
+			name: "memory-sha512",
+			conf: `{"storage": {"kind": "memory", "hash": "sha512"}}`,
+			algo: hasher.SHA512,
+		},
+		{
+			name: "filesystem-blake3",
+			conf: fmt.Sprintf(`{"storage": {"kind": "filesystem", "directory": "%s", "hash": "blake3", "verify": true}}`, t.TempDir()),
+			algo: hasher.BLAKE3,
+		},
+		{
+			name: "bolt-blake3",
+			conf: fmt.Sprintf(`{"storage": {"kind": "bolt", "directory": "%s", "hash": "blake3", "verify": true}}`, t.TempDir()),
+			algo: hasher.BLAKE3,
+		},
+		{
+			name: "tiered-sha512",
+			conf: fmt.Sprintf(`{"storage": {"kind": "tiered", "hash": "sha512", "local": {"kind": "memory"}, "remote": {"kind": "filesystem", "directory": "%s"}}}`, t.TempDir()),
+			algo: hasher.SHA512,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			algo := tt.algo
+			if algo == "" {
+				algo = hasher.Default
+			}
+			sampleHash, err := hasher.FromBytesAlgo(algo, sampleBlob)
+			if err != nil {
+				t.Errorf("failed to get sample blob hash: %v", err)
+				return
+			}
 			c := config.Config{}
-			err := config.LoadReader(strings.NewReader(tt.conf), &c)
+			err = config.LoadReader(strings.NewReader(tt.conf), &c)
 			if err != nil {
 				t.Errorf("failed to read config: %v", err)
 				return
@@ -122,6 +171,9 @@ func TestStorage(t *testing.T) {
 			if err != nil {
 				t.Errorf("failed to save root: %v", err)
 			}
+			if !strings.HasPrefix(rootHash, algo+":") {
+				t.Errorf("root hash %s does not use %s", rootHash, algo)
+			}
 			// open root by uuid
 			rootByID, err := s.RootOpen(id)
 			if err != nil {
@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/httplock/httplock/hasher"
+	"github.com/httplock/httplock/internal/config"
+)
+
+// Tiered storage caches blobs from a shared remote storage in a fast local storage
+
+func init() {
+	Register("tiered", func(c config.Config) (Storage, error) {
+		if c.Storage.Local == nil || c.Storage.Remote == nil {
+			return nil, fmt.Errorf("tiered storage requires local and remote storage")
+		}
+		cLocal := c
+		cLocal.Storage = *c.Storage.Local
+		// both tiers must name new blobs with the same algorithm
+		if cLocal.Storage.Hash == "" {
+			cLocal.Storage.Hash = c.Storage.Hash
+		}
+		local, err := Get(cLocal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup local storage: %w", err)
+		}
+		cRemote := c
+		cRemote.Storage = *c.Storage.Remote
+		if cRemote.Storage.Hash == "" {
+			cRemote.Storage.Hash = c.Storage.Hash
+		}
+		if cLocal.Storage.Hash != cRemote.Storage.Hash {
+			return nil, fmt.Errorf("tiered storage requires the same hash algorithm for local and remote storage")
+		}
+		remote, err := Get(cRemote)
+		if err != nil {
+			return nil, fmt.Errorf("failed to setup remote storage: %w", err)
+		}
+		return NewTiered(local, remote, c.Storage.WriteBack)
+	})
+}
+
+// blobCache is implemented by storage that can be pruned as the local tier
+type blobCache interface {
+	// blobList returns the hash of every blob
+	blobList() ([]string, error)
+	// blobDelete removes a blob
+	blobDelete(hash string) error
+}
+
+// rootTracker is implemented by storage that records when roots are opened
+type rootTracker interface {
+	// rootUsed updates the last used time of a root in the index
+	rootUsed(name string)
+}
+
+type TieredStorage struct {
+	mu        sync.Mutex
+	local     Storage
+	remote    Storage
+	writeBack bool
+	start     time.Time
+	access    map[string]time.Time
+	pending   map[string]bool
+	roots     map[string]*Root
+}
+
+// NewTiered returns a storage that reads from local before remote, populating local on a miss,
+// blobs are written to both unless writeBack is set, in which case they are copied to remote on save or flush
+func NewTiered(local, remote Storage, writeBack bool) (Storage, error) {
+	return &TieredStorage{
+		local:     local,
+		remote:    remote,
+		writeBack: writeBack,
+		start:     time.Now(),
+		access:    map[string]time.Time{},
+		pending:   map[string]bool{},
+		roots:     map[string]*Root{},
+	}, nil
+}
+
+// BlobOpen returns a reader for a blob
+func (t *TieredStorage) BlobOpen(blob string) (BlobReader, error) {
+	br, err := t.local.BlobOpen(blob)
+	if err == nil {
+		t.touch(blob)
+		return br, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	br, err = t.remote.BlobOpen(blob)
+	if err != nil {
+		return nil, err
+	}
+	// track the blob before it is copied so it is not pruned before being opened
+	t.touch(blob)
+	err = t.copyBlob(blob, br, t.local)
+	br.Close()
+	if err == nil {
+		br, err = t.local.BlobOpen(blob)
+	}
+	if err != nil {
+		// the local storage is only a cache, fall back to reading from remote
+		return t.remote.BlobOpen(blob)
+	}
+	return br, nil
+}
+
+// blobSize returns the size of a blob from the local storage, or remote when not cached
+func (t *TieredStorage) blobSize(hash string) (int64, error) {
+	size, err := blobSize(t.local, hash)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return size, err
+	}
+	return blobSize(t.remote, hash)
+}
+
+// BlobCreate returns a writer for a blob
+func (t *TieredStorage) BlobCreate(opts ...BlobOpt) (BlobWriter, error) {
+	lw, err := t.local.BlobCreate(opts...)
+	if err != nil {
+		return nil, err
+	}
+	tw := tieredWriter{
+		t:     t,
+		local: lw,
+	}
+	if !t.writeBack {
+		tw.remote, err = t.remote.BlobCreate(opts...)
+		if err != nil {
+			lw.Close()
+			return nil, err
+		}
+	}
+	return &tw, nil
+}
+
+// Flush copies any pending blobs to remote and flushes both storage tiers
+func (t *TieredStorage) Flush() error {
+	errs := []error{t.flushPending(), t.local.Flush(), t.remote.Flush()}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases both storage tiers
+func (t *TieredStorage) Close() error {
+	var errs []error
+	for _, s := range []Storage{t.local, t.remote} {
+		if c, ok := s.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index returns the roots from both storage tiers
+func (t *TieredStorage) Index() Index {
+	ind := Index{
+		Roots: map[string]*IndexRoot{},
+	}
+	for hash, ir := range t.local.Index().Roots {
+		ind.Roots[hash] = ir
+	}
+	for hash, ir := range t.remote.Index().Roots {
+		ind.Roots[hash] = ir
+	}
+	return ind
+}
+
+// PruneCache deletes blobs from the local storage that haven't been accessed within the duration
+func (t *TieredStorage) PruneCache(d time.Duration) error {
+	bc, ok := t.local.(blobCache)
+	if !ok {
+		return fmt.Errorf("local storage cannot be pruned: %w", ErrNotImplemented)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hashes, err := bc.blobList()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-d)
+	for _, hash := range hashes {
+		if t.pending[hash] {
+			continue
+		}
+		// blobs not accessed since startup are tracked from the start time
+		last, ok := t.access[hash]
+		if !ok {
+			last = t.start
+		}
+		if last.After(cutoff) {
+			continue
+		}
+		err = bc.blobDelete(hash)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		delete(t.access, hash)
+	}
+	return nil
+}
+
+// PruneStorage deletes any blobs that are not used by any root
+func (t *TieredStorage) PruneStorage() error {
+	return ErrNotImplemented
+}
+
+// RootCreate returns a new root using a uuid
+func (t *TieredStorage) RootCreate() (string, *Root, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := fmt.Sprintf("uuid:%s", uuid.New().String())
+	root := newRoot(t)
+	t.roots[u] = root
+	return u, root, nil
+}
+
+// RootCreateFrom returns a new root using a uuid initialized from an existing hash
+func (t *TieredStorage) RootCreateFrom(hash string) (string, *Root, error) {
+	ir, ok := t.Index().Roots[hash]
+	if !ok {
+		return "", nil, fmt.Errorf("hash not found in index: %s", hash)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := fmt.Sprintf("uuid:%s", uuid.New().String())
+	root := newRootHash(t, hash)
+	root.readonly = false
+	root.metaHash = ir.Meta
+	t.roots[u] = root
+	return u, root, nil
+}
+
+// RootOpen returns an existing root
+func (t *TieredStorage) RootOpen(name string) (*Root, error) {
+	t.mu.Lock()
+	root, ok := t.roots[name]
+	t.mu.Unlock()
+	if ok {
+		return root, nil
+	}
+	ir, ok := t.Index().Roots[name]
+	if !ok {
+		return nil, fmt.Errorf("hash not found in index: %s", name)
+	}
+	// the index entries belong to each tier and are updated under that tier's lock
+	for _, tier := range []Storage{t.local, t.remote} {
+		if rt, ok := tier.(rootTracker); ok {
+			rt.rootUsed(name)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	root = newRootHash(t, name)
+	root.metaHash = ir.Meta
+	t.roots[name] = root
+	return root, nil
+}
+
+// RootSave saves a root and adds the hash to the index of both storage tiers
+func (t *TieredStorage) RootSave(r *Root) (string, error) {
+	// both tiers record the same creation time
+	info := r.Info()
+	if info.Created.IsZero() {
+		info.Created = time.Now()
+		r.SetInfo(info)
+	}
+	// blobs are written and copied to remote before the root is added to the remote index
+	_, err := r.Save()
+	if err != nil {
+		return "", err
+	}
+	metaHash, err := r.saveMeta()
+	if err != nil {
+		return "", err
+	}
+	err = t.flushPending()
+	if err != nil {
+		return "", err
+	}
+	hash, err := t.remote.RootSave(r)
+	if err != nil {
+		return "", err
+	}
+	_, err = t.local.RootSave(r)
+	if err != nil {
+		return "", err
+	}
+	// saving to each tier rewrites the directory blobs already in remote
+	err = t.flushPending()
+	if err != nil {
+		return "", err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	newRoot := newRootHash(t, hash)
+	newRoot.metaHash = metaHash
+	t.roots[hash] = newRoot
+	return hash, nil
+}
+
+// touch records the access time of a blob in the local storage
+func (t *TieredStorage) touch(hash string) {
+	t.mu.Lock()
+	t.access[hash] = time.Now()
+	t.mu.Unlock()
+}
+
+// flushPending copies blobs only written to local storage to the remote storage
+func (t *TieredStorage) flushPending() error {
+	t.mu.Lock()
+	hashes := make([]string, 0, len(t.pending))
+	for hash := range t.pending {
+		hashes = append(hashes, hash)
+	}
+	t.mu.Unlock()
+	for _, hash := range hashes {
+		// skip blobs already in remote, e.g. written by another root
+		br, err := t.remote.BlobOpen(hash)
+		if err == nil {
+			br.Close()
+		} else {
+			br, err = t.local.BlobOpen(hash)
+			if err != nil {
+				return err
+			}
+			err = t.copyBlob(hash, br, t.remote)
+			br.Close()
+			if err != nil {
+				return err
+			}
+		}
+		t.mu.Lock()
+		delete(t.pending, hash)
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// copyBlob writes the content of a blob to another storage, verifying the hash
+func (t *TieredStorage) copyBlob(hash string, r io.Reader, s Storage) error {
+	algo, err := hasher.Algorithm(hash)
+	if err != nil {
+		return err
+	}
+	bw, err := s.BlobCreate(WithAlgorithm(algo))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(bw, r)
+	errC := bw.Close()
+	if err == nil {
+		err = errC
+	}
+	if err != nil {
+		return err
+	}
+	bwHash, err := bw.Hash()
+	if err != nil {
+		return err
+	}
+	if bwHash != hash {
+		if bc, ok := s.(blobCache); ok {
+			_ = bc.blobDelete(bwHash)
+		}
+		return fmt.Errorf("blob hash mismatch, expected %s, received %s", hash, bwHash)
+	}
+	return nil
+}
+
+type tieredWriter struct {
+	t      *TieredStorage
+	local  BlobWriter
+	remote BlobWriter
+}
+
+func (tw *tieredWriter) Write(p []byte) (int, error) {
+	n, err := tw.local.Write(p)
+	if err != nil || tw.remote == nil {
+		return n, err
+	}
+	return tw.remote.Write(p[:n])
+}
+
+// Close finishes the blob in each storage tier, write-back blobs are tracked until they are copied to remote
+func (tw *tieredWriter) Close() error {
+	if tw.remote != nil {
+		err := tw.remote.Close()
+		if err != nil {
+			tw.local.Close()
+			return err
+		}
+	}
+	// the lock prevents a prune from removing the local blob before it is tracked
+	tw.t.mu.Lock()
+	defer tw.t.mu.Unlock()
+	err := tw.local.Close()
+	if err != nil {
+		return err
+	}
+	hash, err := tw.local.Hash()
+	if err != nil {
+		return err
+	}
+	if tw.remote != nil {
+		remoteHash, err := tw.remote.Hash()
+		if err != nil {
+			return err
+		}
+		if remoteHash != hash {
+			return fmt.Errorf("blob hash mismatch between tiers, local %s, remote %s", hash, remoteHash)
+		}
+	}
+	tw.t.access[hash] = time.Now()
+	if tw.remote == nil {
+		tw.t.pending[hash] = true
+	}
+	return nil
+}
+
+func (tw *tieredWriter) Hash() (string, error) {
+	return tw.local.Hash()
+}
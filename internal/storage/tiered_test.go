@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTiered(t *testing.T) {
+	content := []byte("tiered blob content")
+	path := []string{"path", "to", "file"}
+	tests := []struct {
+		name      string
+		writeBack bool
+	}{
+		{name: "WriteThrough"},
+		{name: "WriteBack", writeBack: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, _ := NewMemory()
+			remote, _ := NewMemory()
+			s, err := NewTiered(local, remote, tt.writeBack)
+			if err != nil {
+				t.Errorf("failed to create storage: %v", err)
+				return
+			}
+			_, root, err := s.RootCreate()
+			if err != nil {
+				t.Errorf("failed to create root: %v", err)
+				return
+			}
+			bw, err := root.Write(path)
+			if err != nil {
+				t.Errorf("failed to create blob: %v", err)
+				return
+			}
+			_, err = bw.Write(content)
+			if err != nil {
+				t.Errorf("failed to write blob: %v", err)
+				return
+			}
+			err = bw.Close()
+			if err != nil {
+				t.Errorf("failed to close blob: %v", err)
+				return
+			}
+			hash, err := bw.Hash()
+			if err != nil {
+				t.Errorf("failed to get hash: %v", err)
+				return
+			}
+			if _, err := local.BlobOpen(hash); err != nil {
+				t.Errorf("blob missing from local: %v", err)
+			}
+			_, err = remote.BlobOpen(hash)
+			if tt.writeBack && err == nil {
+				t.Errorf("write back blob copied to remote before save")
+			} else if !tt.writeBack && err != nil {
+				t.Errorf("write through blob missing from remote: %v", err)
+			}
+			if tt.writeBack {
+				// pending blobs are not pruned
+				err = s.PruneCache(0)
+				if err != nil {
+					t.Errorf("failed to prune cache: %v", err)
+					return
+				}
+				if _, err := local.BlobOpen(hash); err != nil {
+					t.Errorf("pending blob was pruned: %v", err)
+				}
+			}
+			rootHash, err := s.RootSave(root)
+			if err != nil {
+				t.Errorf("failed to save root: %v", err)
+				return
+			}
+			if _, ok := remote.Index().Roots[rootHash]; !ok {
+				t.Errorf("root missing from remote index")
+			}
+			if _, err := remote.BlobOpen(hash); err != nil {
+				t.Errorf("blob missing from remote after save: %v", err)
+			}
+
+			// recently accessed blobs are kept
+			err = s.PruneCache(time.Hour)
+			if err != nil {
+				t.Errorf("failed to prune cache: %v", err)
+				return
+			}
+			if _, err := local.BlobOpen(hash); err != nil {
+				t.Errorf("recently used blob was pruned: %v", err)
+			}
+			err = s.PruneCache(0)
+			if err != nil {
+				t.Errorf("failed to prune cache: %v", err)
+				return
+			}
+			if hashes, _ := local.(blobCache).blobList(); len(hashes) != 0 {
+				t.Errorf("blobs remain in local after prune: %v", hashes)
+			}
+
+			// a new tiered storage with an empty local reads from remote and populates local
+			local2, _ := NewMemory()
+			s2, _ := NewTiered(local2, remote, tt.writeBack)
+			opened := time.Now()
+			// another tiered storage sharing the remote updates the same index entry
+			local3, _ := NewMemory()
+			s3, _ := NewTiered(local3, remote, tt.writeBack)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = s3.RootOpen(rootHash)
+			}()
+			root2, err := s2.RootOpen(rootHash)
+			wg.Wait()
+			if err != nil {
+				t.Errorf("failed to open root: %v", err)
+				return
+			}
+			if used := remote.Index().Roots[rootHash].Used; used.Before(opened) {
+				t.Errorf("root used time not updated, %v before %v", used, opened)
+			}
+			br, err := root2.Read(path)
+			if err != nil {
+				t.Errorf("failed to read blob: %v", err)
+				return
+			}
+			b, err := io.ReadAll(br)
+			br.Close()
+			if err != nil || !bytes.Equal(b, content) {
+				t.Errorf("blob mismatch, received %s: %v", b, err)
+			}
+			if _, err := local2.BlobOpen(hash); err != nil {
+				t.Errorf("blob not populated in local: %v", err)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
 	"os"
 	"os/signal"
 	"syscall"
@@ -62,6 +64,33 @@ func runServer(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	// periodically prune unused blobs from the storage cache
+	pruneDone := make(chan struct{})
+	pruneStopped := make(chan struct{})
+	if conf.Storage.CacheExpire > 0 {
+		ticker := time.NewTicker(conf.Storage.CacheExpire)
+		go func() {
+			defer close(pruneStopped)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-pruneDone:
+					return
+				case <-ticker.C:
+				}
+				err := s.PruneCache(conf.Storage.CacheExpire)
+				if errors.Is(err, storage.ErrNotImplemented) {
+					log.Warnf("storage kind %s does not support cache expiration", conf.Storage.Kind)
+					return
+				} else if err != nil {
+					log.Warnf("failed to prune storage cache: %v", err)
+				}
+			}
+		}()
+	} else {
+		close(pruneStopped)
+	}
+
 	// setup cert generation
 	c := cert.NewCert()
 	// TODO: load CA from config if provided
@@ -90,6 +119,8 @@ func runServer(cmd *cobra.Command, args []string) error {
 	defer cancel()
 	proxySvc.Shutdown(ctxShutdown)
 	apiSvc.Shutdown(ctxShutdown)
+	close(pruneDone)
+	<-pruneStopped
 
 	// update index files
 	err = s.Flush()
@@ -97,5 +128,13 @@ func runServer(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	// release the storage, removing any temp files
+	if c, ok := s.(io.Closer); ok {
+		err = c.Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }